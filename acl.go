@@ -0,0 +1,215 @@
+package revssh
+
+import (
+	"log"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// An AccessController is a ServerSettingsHandler that lets users reach reverse
+// clients registered by other users. Users can always reach their own.
+type AccessController interface {
+	// CanAccess reports whether user, authenticated with key, may reach rc.
+	CanAccess(user *User, key ssh.PublicKey, rc *ReverseClientHandler) bool
+}
+
+// A GroupResolver is a ServerSettingsHandler with groups besides those set on
+// the users, such as the groups of an acl file.
+type GroupResolver interface {
+	// InGroup reports whether user is a member of group.
+	InGroup(user *User, group string) bool
+}
+
+// An ACL grants users, groups and keys access to reverse clients.
+type ACL struct {
+	Groups map[string][]string // group name to its members, besides User.Groups.
+	Rules  []ACLRule
+}
+
+// An ACLRule grants a subject access to the reverse clients matching any of
+// its targets.
+type ACLRule struct {
+	Subject   string     // a username, "@group", a SHA256 key fingerprint or "*".
+	Hosts     []string   // hostname patterns, as in path.Match.
+	Owners    []string   // users whose reverse clients are granted.
+	Selectors []Selector // label selectors.
+}
+
+// ParseACL parses an acl file. Every line either defines a group:
+//
+//	group ops alice bob
+//
+// or allows a subject access to targets, which are "host:<pattern>",
+// "user:<name>" or a label selector:
+//
+//	allow @ops host:*.edge user:deploy site=ams,role=db
+func ParseACL(path string, data []byte) *ACL {
+	acl := &ACL{Groups: make(map[string][]string)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			log.Printf("ERROR: %s:%d: expected %s with at least two arguments, skipping", path, i+1, fields[0])
+			continue
+		}
+		switch fields[0] {
+		case "group":
+			acl.Groups[fields[1]] = append(acl.Groups[fields[1]], fields[2:]...)
+		case "allow":
+			rule, err := parseACLRule(fields[1], fields[2:])
+			if err != nil {
+				log.Printf("ERROR: %s:%d: %s, skipping", path, i+1, err)
+				continue
+			}
+			acl.Rules = append(acl.Rules, rule)
+		default:
+			log.Printf("ERROR: %s:%d: unknown directive %q, skipping", path, i+1, fields[0])
+		}
+	}
+	return acl
+}
+
+func parseACLRule(subject string, targets []string) (ACLRule, error) {
+	rule := ACLRule{Subject: subject}
+	for _, target := range targets {
+		switch {
+		case strings.HasPrefix(target, "host:"):
+			pattern := strings.ToLower(target[len("host:"):])
+			if _, err := path.Match(pattern, ""); err != nil {
+				return rule, err
+			}
+			rule.Hosts = append(rule.Hosts, pattern)
+		case strings.HasPrefix(target, "user:"):
+			rule.Owners = append(rule.Owners, target[len("user:"):])
+		default:
+			sel, err := ParseSelector(target)
+			if err != nil {
+				return rule, err
+			}
+			rule.Selectors = append(rule.Selectors, sel)
+		}
+	}
+	return rule, nil
+}
+
+// CanAccess reports whether a rule for user, one of its groups or key grants
+// access to rc.
+func (acl *ACL) CanAccess(user *User, key ssh.PublicKey, rc *ReverseClientHandler) bool {
+	if acl == nil {
+		return false
+	}
+	fingerprint := ""
+	if key != nil {
+		fingerprint = ssh.FingerprintSHA256(key)
+	}
+	for _, rule := range acl.Rules {
+		if acl.isSubject(rule.Subject, user, fingerprint) && rule.matches(rc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *ACL) isSubject(subject string, user *User, fingerprint string) bool {
+	if strings.HasPrefix(subject, "@") {
+		return acl.InGroup(user, subject[1:])
+	}
+	return isSubject(subject, user, fingerprint)
+}
+
+// InGroup reports whether user is a member of group, either by its own groups
+// or by a group line.
+func (acl *ACL) InGroup(user *User, group string) bool {
+	if user.InGroup(group) {
+		return true
+	}
+	if acl == nil {
+		return false
+	}
+	for _, member := range acl.Groups[group] {
+		if member == user.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubject is like the package isSubject, with the groups of the settings if
+// they are a GroupResolver.
+func (srv *Server) isSubject(subject string, user *User, fingerprint string) bool {
+	if gr, ok := srv.Settings.(GroupResolver); ok && strings.HasPrefix(subject, "@") {
+		return gr.InGroup(user, subject[1:])
+	}
+	return isSubject(subject, user, fingerprint)
+}
+
+// isSubject reports whether subject names user, one of its groups or key.
+func isSubject(subject string, user *User, fingerprint string) bool {
+	switch {
+	case subject == "*" || subject == user.Name:
+		return true
+	case strings.HasPrefix(subject, "SHA256:"):
+		return subject == fingerprint
+	case strings.HasPrefix(subject, "@"):
+		return user.InGroup(subject[1:])
+	}
+	return false
+}
+
+func (rule *ACLRule) matches(rc *ReverseClientHandler) bool {
+	for _, owner := range rule.Owners {
+		if owner == rc.Username {
+			return true
+		}
+	}
+	for _, pattern := range rule.Hosts {
+		for _, name := range rc.Names() {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	for _, sel := range rule.Selectors {
+		if sel.Matches(rc.Labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccess reports whether the user of sshConn may reach rc. Admins reach
+// every reverse client.
+func (srv *Server) canAccess(sshConn *ssh.ServerConn, rc *ReverseClientHandler) bool {
+	if rc.Username == sshConn.User() {
+		return true
+	}
+	u := srv.user(sshConn)
+	if u.HasRole(RoleAdmin) {
+		return true
+	}
+	ac, ok := srv.Settings.(AccessController)
+	if !ok {
+		return false
+	}
+	return ac.CanAccess(u, connKey(sshConn), rc)
+}
+
+// accessibleClients returns the reverse clients the user of sshConn may reach
+// whose labels match sel.
+func (srv *Server) accessibleClients(sshConn *ssh.ServerConn, sel Selector) []*ReverseClientHandler {
+	if _, ok := srv.Settings.(AccessController); !ok && !srv.user(sshConn).HasRole(RoleAdmin) {
+		return srv.SelectReverseClients(sshConn.User(), sel)
+	}
+	var list []*ReverseClientHandler
+	for _, rc := range srv.ListReverseClients() {
+		if sel.Matches(rc.Labels) && srv.canAccess(sshConn, rc) {
+			list = append(list, rc)
+		}
+	}
+	return list
+}
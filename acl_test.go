@@ -0,0 +1,149 @@
+package revssh
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseACL(t *testing.T) {
+	data := []byte(`# comment
+group ops alice bob
+group ops carol
+group net dave
+
+allow @ops host:*.Edge user:deploy site=ams,role=db
+allow SHA256:abc host:db-?
+allow * role=public
+allow eve
+bogus eve host:x
+allow eve host:[
+allow eve =x
+`)
+	acl := ParseACL("acl", data)
+	wantGroups := map[string][]string{"ops": {"alice", "bob", "carol"}, "net": {"dave"}}
+	if !reflect.DeepEqual(acl.Groups, wantGroups) {
+		t.Errorf("groups = %v, want %v", acl.Groups, wantGroups)
+	}
+	sel, _ := ParseSelector("site=ams,role=db")
+	public, _ := ParseSelector("role=public")
+	wantRules := []ACLRule{
+		{Subject: "@ops", Hosts: []string{"*.edge"}, Owners: []string{"deploy"}, Selectors: []Selector{sel}},
+		{Subject: "SHA256:abc", Hosts: []string{"db-?"}},
+		{Subject: "*", Selectors: []Selector{public}},
+	}
+	if !reflect.DeepEqual(acl.Rules, wantRules) {
+		t.Errorf("rules = %+v, want %+v", acl.Rules, wantRules)
+	}
+}
+
+func TestACLCanAccess(t *testing.T) {
+	acl := ParseACL("acl", []byte(`group ops bob
+allow @ops host:*.edge
+allow @net user:deploy
+allow SHA256:abc host:db-1
+allow * role=public
+`))
+	alice := &User{Name: "alice"}
+	bob := &User{Name: "bob"}
+	netUser := &User{Name: "nina", Groups: []string{"net"}}
+	edge := &ReverseClientHandler{Hostname: "web.edge", Username: "x"}
+	tests := []struct {
+		name        string
+		user        *User
+		fingerprint string
+		rc          *ReverseClientHandler
+		want        bool
+	}{
+		{"group line", bob, "", edge, true},
+		{"not in group", alice, "", edge, false},
+		{"user groups", netUser, "", &ReverseClientHandler{Hostname: "h", Username: "deploy"}, true},
+		{"other owner", netUser, "", &ReverseClientHandler{Hostname: "h", Username: "root"}, false},
+		{"key", alice, "SHA256:abc", &ReverseClientHandler{Hostname: "db-1"}, true},
+		{"other key", alice, "SHA256:xyz", &ReverseClientHandler{Hostname: "db-1"}, false},
+		{"everyone", alice, "", &ReverseClientHandler{Hostname: "h", Labels: map[string]string{"role": "public"}}, true},
+	}
+	for _, tt := range tests {
+		got := false
+		for _, rule := range acl.Rules {
+			got = got || acl.isSubject(rule.Subject, tt.user, tt.fingerprint) && rule.matches(tt.rc)
+		}
+		if got != tt.want {
+			t.Errorf("%s: access = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if (*ACL)(nil).CanAccess(bob, nil, edge) {
+		t.Error("nil ACL grants access")
+	}
+}
+
+// testNewChannel is a direct-tcpip channel request, which records how it was
+// answered.
+type testNewChannel struct {
+	extra    []byte
+	rejected ssh.RejectionReason
+	accepted bool
+}
+
+func (c *testNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	c.accepted = true
+	return nil, nil, errors.New("test channel")
+}
+
+func (c *testNewChannel) Reject(reason ssh.RejectionReason, message string) error {
+	c.rejected = reason
+	return nil
+}
+
+func (c *testNewChannel) ChannelType() string { return "direct-tcpip" }
+func (c *testNewChannel) ExtraData() []byte   { return c.extra }
+
+func TestForwardingToInaccessibleClient(t *testing.T) {
+	signer, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, portStr, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	host := "localhost"
+
+	srv := NewServer()
+	srv.Settings = NewMemoryKeyManager()
+	srv.ReservedHostnames = nil
+	// bob's reverse client holds the name of a host alice could dial.
+	if err := srv.ReverseClientList.NewReverseClient(benchServerConn("bob", []byte("bob"), signer.PublicKey()), &ReverseClientData{Hostname: host}); err != nil {
+		t.Fatal(err)
+	}
+	alice := benchServerConn("alice", []byte("alice"), signer.PublicKey())
+	newChan := &testNewChannel{extra: ssh.Marshal(&forwardData{DestinationHost: host, DestinationPort: uint32(port)})}
+	directTcpipChannelHandler(srv, alice, newChan)
+	if newChan.accepted || newChan.rejected != ssh.Prohibited {
+		t.Errorf("forwarding to bob's %s: accepted %v, rejected %v, want rejected %v", host, newChan.accepted, newChan.rejected, ssh.Prohibited)
+	}
+
+	// names no reverse client holds are dialed.
+	srv.ReverseClientList.RemoveReverseClient([]byte("bob"))
+	newChan = &testNewChannel{extra: newChan.extra}
+	directTcpipChannelHandler(srv, alice, newChan)
+	if !newChan.accepted {
+		t.Errorf("forwarding to unregistered %s: rejected %v, want dialed", host, newChan.rejected)
+	}
+}
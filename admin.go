@@ -0,0 +1,157 @@
+package revssh
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// An adminCommand runs an exec request on a server registering reverse
+// clients, writing its output to w.
+type adminCommand func(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error
+
+var adminCommands map[string]adminCommand
+
+func init() {
+	adminCommands = map[string]adminCommand{
+		"approvals":   approvalsCommand,
+		"approve":     approveCommand,
+		"deny":        denyCommand,
+		"grant":       grantCommand,
+		"grants":      grantsCommand,
+		"help":        helpCommand,
+		"known-hosts": knownHostsCommand,
+		"list":        listCommand,
+		"revoke":      revokeCommand,
+		"whoami":      whoamiCommand,
+	}
+}
+
+// adminCommandRoles holds the role a user needs to run a command, if any.
+var adminCommandRoles = map[string]Role{
+	"approvals": RoleAdmin,
+	"approve":   RoleAdmin,
+	"deny":      RoleAdmin,
+	"grant":     RoleAdmin,
+	"grants":    RoleAdmin,
+	"revoke":    RoleAdmin,
+}
+
+// execRequest runs the admin command from an exec request, and closes the
+// channel with its exit status.
+func execRequest(srv *Server, sshConn *ssh.ServerConn, channel ssh.Channel, req *ssh.Request) {
+	var payload struct{ Command string }
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	args := strings.Fields(payload.Command)
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+	req.Reply(true, nil)
+	log.Printf("ADMIN: %s ran %q", sshConn.User(), payload.Command)
+	status := uint32(0)
+	cmd, found := adminCommands[args[0]]
+	if !found {
+		fmt.Fprintf(channel.Stderr(), "unknown command: %s\n", args[0])
+		status = 127
+	} else if role, ok := adminCommandRoles[args[0]]; ok && !srv.user(sshConn).HasRole(role) {
+		fmt.Fprintf(channel.Stderr(), "%s: requires the %s role\n", args[0], role)
+		status = 1
+	} else if err := cmd(srv, sshConn, args[1:], channel); err != nil {
+		fmt.Fprintf(channel.Stderr(), "%s: %s\n", args[0], err)
+		status = 1
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	channel.Close()
+}
+
+func helpCommand(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error {
+	var names []string
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "commands: %s\n", strings.Join(names, ", "))
+	return nil
+}
+
+// whoamiCommand prints the username, role and groups of this user.
+func whoamiCommand(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error {
+	u := srv.user(sshConn)
+	role := u.Role
+	if role == "" {
+		role = RoleOperator
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\n", u.Name, role, strings.Join(u.Groups, ","))
+	return nil
+}
+
+// listCommand prints the reverse clients this user can reach, optionally
+// limited by a label selector.
+func listCommand(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error {
+	sel, err := ParseSelector(strings.Join(args, ","))
+	if err != nil {
+		return err
+	}
+	for _, rc := range srv.accessibleClients(sshConn, sel) {
+		lastSeen, rtt := rc.LastSeen()
+		labels := strings.Join(FormatLabels(rc.Labels), ",")
+		if labels == "" {
+			labels = "-"
+		}
+		aliases := strings.Join(rc.Aliases, ",")
+		if aliases == "" {
+			aliases = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", srv.canonicalHostname(rc.Hostname), aliases, labels, lastSeen.Format(time.RFC3339), rtt)
+	}
+	return nil
+}
+
+// knownHostsCommand prints the host keys of the reverse clients this user can
+// reach, in known_hosts format, optionally limited to the given hostnames. If
+// the server has a host CA, it is listed as a @cert-authority for them.
+func knownHostsCommand(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error {
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		if name, err := srv.normalizeHostname(arg); err == nil {
+			wanted[name] = true
+		}
+	}
+	// the CA only vouches for names in the virtual domain.
+	if domain := srv.virtualDomain(); srv.HostCA != nil && domain != "" {
+		patterns := []string{"*." + domain}
+		if len(wanted) > 0 {
+			patterns = nil
+			for name := range wanted {
+				patterns = append(patterns, srv.canonicalHostname(name))
+			}
+			sort.Strings(patterns)
+		}
+		fmt.Fprintf(w, "@cert-authority %s\n", knownhosts.Line(patterns, srv.HostCA.PublicKey()))
+	}
+	for _, rc := range srv.accessibleClients(sshConn, nil) {
+		names := srv.qualifiedNames(rc)
+		if len(wanted) > 0 {
+			found := false
+			for _, name := range rc.Names() {
+				found = found || wanted[name]
+			}
+			if !found {
+				continue
+			}
+		}
+		for _, key := range rc.HostKeys {
+			fmt.Fprintln(w, knownhosts.Line(names, key))
+		}
+	}
+	return nil
+}
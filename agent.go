@@ -0,0 +1,101 @@
+package revssh
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AgentSigners returns a function listing the signers of the ssh-agent
+// listening on socket, or on $SSH_AUTH_SOCK if socket is empty. The agent is
+// dialed anew on every call, so a restarted agent is picked up on the next
+// connection attempt.
+func AgentSigners(socket string) func() ([]ssh.Signer, error) {
+	var conn net.Conn
+	var mu sync.Mutex
+	return func() ([]ssh.Signer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := socket
+		if path == "" {
+			path = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if path == "" {
+			return nil, errors.New("no ssh-agent socket, SSH_AUTH_SOCK is not set")
+		}
+		if conn != nil {
+			// signers from the previous call are no longer in use.
+			conn.Close()
+			conn = nil
+		}
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		conn = c
+		return agent.NewClient(c).Signers()
+	}
+}
+
+// ServeAgent serves the keys of an in-process agent, such as one from
+// agent.NewKeyring, on a unix socket at path, so keys can be added to it with
+// ssh-add without ever being written to disk. Closing the returned listener
+// stops serving.
+func ServeAgent(keyring agent.Agent, path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// bind in a private directory, so nobody can connect before the socket
+	// is restricted to us, then move it into place.
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".agent")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "agent.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	log.Printf("Serving ssh-agent on %s", path)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return &agentListener{UnixListener: l, path: path}, nil
+}
+
+// agentListener removes the agent socket once closed.
+type agentListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *agentListener) Close() error {
+	os.Remove(l.path)
+	return l.UnixListener.Close()
+}
@@ -0,0 +1,80 @@
+package revssh
+
+import (
+	"log"
+	"strings"
+)
+
+// maxAliases caps the number of aliases a reverse client can register.
+const maxAliases = 32
+
+// An AliasProvider is a ServerSettingsHandler that assigns extra names to
+// reverse clients.
+type AliasProvider interface {
+	// GetAliases returns the aliases configured for hostname.
+	GetAliases(hostname string) []string
+}
+
+// Names returns the hostname and aliases of the reverse client.
+func (rc *ReverseClientHandler) Names() []string {
+	return append([]string{rc.Hostname}, rc.Aliases...)
+}
+
+// hasName reports whether the reverse client goes by name.
+func (rc *ReverseClientHandler) hasName(name string) bool {
+	name = strings.ToLower(name)
+	if rc.Hostname == name {
+		return true
+	}
+	for _, alias := range rc.Aliases {
+		if alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanAliases lowercases aliases, dropping empty ones, duplicates and the
+// hostname itself.
+func cleanAliases(hostname string, aliases []string) []string {
+	seen := map[string]bool{strings.ToLower(hostname): true}
+	var clean []string
+	for _, alias := range aliases {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		if alias == "" || seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		clean = append(clean, alias)
+	}
+	return clean
+}
+
+// parseAliases parses an aliases file, with a hostname followed by its
+// aliases on every line.
+func parseAliases(path string, data []byte) map[string][]string {
+	aliases := make(map[string][]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			log.Printf("ERROR: %s:%d: no aliases for %s, skipping", path, i+1, fields[0])
+			continue
+		}
+		hostname := strings.ToLower(fields[0])
+		aliases[hostname] = append(aliases[hostname], fields[1:]...)
+	}
+	return aliases
+}
+
+func containsHandler(list []*ReverseClientHandler, rc *ReverseClientHandler) bool {
+	for i := range list {
+		if list[i] == rc {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package revssh
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxApprovalHistory caps the number of decisions kept for the approvals
+// command.
+const maxApprovalHistory = 100
+
+// An approval is a request to forward to a sensitive reverse client, waiting
+// for another admin to decide on it.
+type approval struct {
+	ID        string
+	User      string
+	Session   string // hex session ID of the requesting connection.
+	Key       string // SHA256 fingerprint of the key the requester logged in with.
+	Remote    string
+	Hostname  string
+	Requested time.Time
+
+	Approved         bool
+	DecidedBy        string // "" if the request timed out.
+	DecidedBySession string
+	DecidedByKey     string
+	Decided          time.Time
+
+	decided chan struct{}
+}
+
+// An ApprovalRecorder is a ServerSettingsHandler that keeps a record of the
+// decisions on approval requests.
+type ApprovalRecorder interface {
+	// RecordApproval records a decision, see approval.record.
+	RecordApproval(record string) error
+}
+
+// String describes the request and its decision, if any.
+func (a *approval) String() string {
+	s := fmt.Sprintf("%s\t%s\t%s\t%s\t%s", a.ID, a.User, a.Remote, a.Hostname, a.Requested.Format(time.RFC3339))
+	switch {
+	case a.Decided.IsZero():
+		return s + "\tpending"
+	case a.DecidedBy == "":
+		return s + "\ttimed out"
+	case a.Approved:
+		return s + "\tapproved by " + a.DecidedBy
+	}
+	return s + "\tdenied by " + a.DecidedBy
+}
+
+// record describes a decided request for the record, with the sessions and
+// keys of the requester and of the admin that decided:
+//
+//	id decided-time decision hostname requested-time user session key remote [admin session key]
+func (a *approval) record() string {
+	decision := "denied"
+	switch {
+	case a.DecidedBy == "":
+		decision = "timed-out"
+	case a.Approved:
+		decision = "approved"
+	}
+	s := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s", a.ID, a.Decided.Format(time.RFC3339), decision,
+		a.Hostname, a.Requested.Format(time.RFC3339), a.User, a.Session, a.Key, a.Remote)
+	if a.DecidedBy != "" {
+		s += fmt.Sprintf("\t%s\t%s\t%s", a.DecidedBy, a.DecidedBySession, a.DecidedByKey)
+	}
+	return s
+}
+
+// approvalList holds the pending approval requests of a server, and the most
+// recent decisions.
+type approvalList struct {
+	pending map[string]*approval
+	history []*approval
+	next    uint64
+	sync.Mutex
+}
+
+// needsApproval reports whether forwarding to rc needs the approval of
+// another admin. Only the labels the settings assign are matched, a reverse
+// client can't opt out by registering other labels.
+func (srv *Server) needsApproval(rc *ReverseClientHandler) bool {
+	if len(srv.ApprovalSelector) == 0 {
+		return false
+	}
+	return srv.ApprovalSelector.Matches(srv.assignedLabels(rc))
+}
+
+// requestApproval raises an approval request for the user of sshConn to
+// forward to rc, and waits until an admin decides on it or it times out.
+func (srv *Server) requestApproval(sshConn *ssh.ServerConn, rc *ReverseClientHandler) *approval {
+	al := &srv.approvals
+	al.Lock()
+	if al.pending == nil {
+		al.pending = make(map[string]*approval)
+	}
+	al.next++
+	a := &approval{
+		ID:        strconv.FormatUint(al.next, 10),
+		User:      sshConn.User(),
+		Session:   hex.EncodeToString(sshConn.SessionID()),
+		Key:       connFingerprint(sshConn),
+		Remote:    sshConn.RemoteAddr().String(),
+		Hostname:  rc.Hostname,
+		Requested: time.Now(),
+		decided:   make(chan struct{}),
+	}
+	al.pending[a.ID] = a
+	al.Unlock()
+	log.Printf("APPROVAL: %s requested by %s (session %s, key %s) for %s", a.ID, a.User, a.Session, a.Key, a.Hostname)
+
+	timeout := time.NewTimer(srv.ApprovalTimeout)
+	defer timeout.Stop()
+	select {
+	case <-a.decided:
+	case <-timeout.C:
+		srv.decide(a.ID, nil, false)
+		<-a.decided
+	}
+	record := a.record()
+	log.Printf("APPROVAL: %s", record)
+	if ar, ok := srv.Settings.(ApprovalRecorder); ok {
+		if err := ar.RecordApproval(record); err != nil {
+			log.Printf("ERROR: recording approval %s: %+v", a.ID, err)
+		}
+	}
+	return a
+}
+
+// decide records the decision of the admin of sshConn on a pending request. A
+// nil sshConn marks a timeout.
+func (srv *Server) decide(id string, sshConn *ssh.ServerConn, approved bool) error {
+	al := &srv.approvals
+	al.Lock()
+	defer al.Unlock()
+	a, ok := al.pending[id]
+	if !ok {
+		return fmt.Errorf("no pending request %s", id)
+	}
+	if sshConn != nil {
+		if sshConn.User() == a.User || (a.Key != "" && connFingerprint(sshConn) == a.Key) {
+			return errors.New("can't decide on your own request")
+		}
+		a.DecidedBy = sshConn.User()
+		a.DecidedBySession = hex.EncodeToString(sshConn.SessionID())
+		a.DecidedByKey = connFingerprint(sshConn)
+	}
+	delete(al.pending, id)
+	a.Approved, a.Decided = approved, time.Now()
+	al.history = append(al.history, a)
+	if len(al.history) > maxApprovalHistory {
+		al.history = al.history[len(al.history)-maxApprovalHistory:]
+	}
+	close(a.decided)
+	return nil
+}
+
+// approvalsCommand prints the pending approval requests, and with -a the
+// recent decisions as well.
+func approvalsCommand(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error {
+	al := &srv.approvals
+	al.Lock()
+	defer al.Unlock()
+	if len(args) > 0 && args[0] == "-a" {
+		for _, a := range al.history {
+			fmt.Fprintln(w, a)
+		}
+	}
+	var ids []int
+	for id := range al.pending {
+		n, _ := strconv.Atoi(id)
+		ids = append(ids, n)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fmt.Fprintln(w, al.pending[strconv.Itoa(id)])
+	}
+	return nil
+}
+
+// approveCommand approves the pending requests with the given IDs.
+func approveCommand(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error {
+	return decideCommand(srv, sshConn, args, true)
+}
+
+// denyCommand denies the pending requests with the given IDs.
+func denyCommand(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error {
+	return decideCommand(srv, sshConn, args, false)
+}
+
+func decideCommand(srv *Server, sshConn *ssh.ServerConn, args []string, approved bool) error {
+	if len(args) == 0 {
+		return errors.New("missing request ID")
+	}
+	for _, id := range args {
+		if err := srv.decide(id, sshConn, approved); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package revssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cnf/revssh/revutil"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// supportedKeyOptions are the authorized_keys options the server understands.
+// Options that only matter to a shell, which the server doesn't offer, are
+// accepted and ignored.
+var supportedKeyOptions = map[string]bool{
+	"cert-authority":      true,
+	"principals":          true,
+	"from":                true,
+	"expiry-time":         true,
+	"restrict":            true,
+	"no-port-forwarding":  true,
+	"port-forwarding":     true,
+	"permitopen":          true,
+	"no-pty":              true,
+	"pty":                 true,
+	"no-agent-forwarding": true,
+	"no-X11-forwarding":   true,
+	"no-user-rc":          true,
+}
+
+// An AuthorizedKey is a public key, or a certificate authority, with the
+// options and comment of its authorized_keys line.
+type AuthorizedKey struct {
+	Key      ssh.PublicKey
+	Options  []string
+	Comment  string
+	Username string // username this key is valid for, the registering user's if empty.
+}
+
+// ParseAuthorizedKeyLine parses an authorized_keys line, rejecting options
+// the server does not understand.
+func ParseAuthorizedKeyLine(line string) (*AuthorizedKey, error) {
+	key, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return nil, errors.New("more than one key on a line")
+	}
+	ak := &AuthorizedKey{Key: key, Options: options, Comment: comment}
+	for _, opt := range options {
+		name := strings.SplitN(opt, "=", 2)[0]
+		if !supportedKeyOptions[name] {
+			return nil, fmt.Errorf("unsupported option %s", name)
+		}
+	}
+	if v, ok := ak.option("expiry-time"); ok {
+		if _, err := parseExpiryTime(v); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := ak.option("principals"); ok && !ak.certAuthority() {
+		return nil, errors.New("principals without cert-authority")
+	}
+	if _, isCert := key.(*ssh.Certificate); isCert && ak.certAuthority() {
+		return nil, errors.New("cert-authority on a certificate")
+	}
+	return ak, nil
+}
+
+// String returns the key as an authorized_keys line.
+func (ak *AuthorizedKey) String() string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ak.Key)))
+	if len(ak.Options) > 0 {
+		line = strings.Join(ak.Options, ",") + " " + line
+	}
+	if ak.Comment != "" {
+		line += " " + ak.Comment
+	}
+	return line
+}
+
+func (ak *AuthorizedKey) certAuthority() bool {
+	_, ok := ak.option("cert-authority")
+	return ok
+}
+
+// option returns the unquoted value of the named option, and whether it is
+// set.
+func (ak *AuthorizedKey) option(name string) (string, bool) {
+	for _, opt := range ak.Options {
+		parts := strings.SplitN(opt, "=", 2)
+		if parts[0] != name {
+			continue
+		}
+		if len(parts) == 1 {
+			return "", true
+		}
+		if v, err := strconv.Unquote(parts[1]); err == nil {
+			return v, true
+		}
+		return parts[1], true
+	}
+	return "", false
+}
+
+// options returns the unquoted values of all options with this name.
+func (ak *AuthorizedKey) options(name string) []string {
+	var values []string
+	for _, opt := range ak.Options {
+		parts := strings.SplitN(opt, "=", 2)
+		if parts[0] != name || len(parts) == 1 {
+			continue
+		}
+		v, err := strconv.Unquote(parts[1])
+		if err != nil {
+			v = parts[1]
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// Authorize checks whether key may log in as username from the remote
+// address, either being this key or a certificate signed by it. The returned
+// permissions carry the forwarding restrictions of the key.
+func (ak *AuthorizedKey) Authorize(username string, remote net.Addr, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if ak.certAuthority() {
+		cert, ok := key.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.UserCert || !revutil.KeysEqual(cert.SignatureKey, ak.Key) {
+			return nil, errors.New("key does not match")
+		}
+		principal := username
+		if v, ok := ak.option("principals"); ok {
+			principal = ""
+			for _, p := range strings.Split(v, ",") {
+				for _, vp := range cert.ValidPrincipals {
+					if p == vp && principal == "" {
+						principal = vp
+					}
+				}
+			}
+			if principal == "" {
+				return nil, errors.New("certificate has none of the allowed principals")
+			}
+		}
+		checker := &ssh.CertChecker{}
+		if err := checker.CheckCert(principal, cert); err != nil {
+			return nil, err
+		}
+	} else if !revutil.KeysEqual(ak.Key, key) {
+		return nil, errors.New("key does not match")
+	}
+	if v, ok := ak.option("expiry-time"); ok {
+		expiry, _ := parseExpiryTime(v)
+		if time.Now().After(expiry) {
+			return nil, errors.New("key expired")
+		}
+	}
+	if v, ok := ak.option("from"); ok && !matchFrom(v, remote) {
+		return nil, fmt.Errorf("key not allowed from %s", addrIP(remote))
+	}
+	perm := &ssh.Permissions{Extensions: map[string]string{}}
+	_, restricted := ak.option("restrict")
+	_, allowed := ak.option("port-forwarding")
+	if _, ok := ak.option("no-port-forwarding"); ok || (restricted && !allowed) {
+		perm.Extensions["no-port-forwarding"] = ""
+	}
+	if opens := ak.options("permitopen"); len(opens) > 0 {
+		perm.Extensions["permitopen"] = strings.Join(opens, ",")
+	}
+	return perm, nil
+}
+
+// parseExpiryTime parses an expiry-time option, YYYYMMDD[HHMM[SS]] in local
+// time.
+func parseExpiryTime(v string) (time.Time, error) {
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(v) == len(layout) {
+			return time.ParseInLocation(layout, v, time.Local)
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", v)
+}
+
+// matchFrom matches a remote address against a from option: comma separated
+// addresses, CIDR networks and wildcard patterns, negated with "!".
+func matchFrom(patterns string, remote net.Addr) bool {
+	ip := addrIP(remote)
+	parsed := net.ParseIP(ip)
+	matched := false
+	for _, p := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		var ok bool
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			ok = parsed != nil && n.Contains(parsed)
+		} else {
+			ok, _ = path.Match(p, ip)
+		}
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// permitOpen checks a forwarding destination against the restrictions in
+// the permissions of a connection.
+func permitOpen(perm *ssh.Permissions, host string, port uint32) error {
+	if perm == nil {
+		return nil
+	}
+	if _, ok := perm.Extensions["no-port-forwarding"]; ok {
+		return errors.New("port forwarding is not allowed for this key")
+	}
+	opens, ok := perm.Extensions["permitopen"]
+	if !ok {
+		return nil
+	}
+	for _, open := range strings.Split(opens, ",") {
+		h, p, err := net.SplitHostPort(open)
+		if err != nil {
+			continue
+		}
+		if (h == "*" || strings.EqualFold(h, host)) && (p == "*" || p == strconv.Itoa(int(port))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("forwarding to %s is not permitted for this key", net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+// restrictPermitOpen limits the forwarding perm permits to hosts, on the ports
+// it already permits, or any port if it permits every destination.
+func restrictPermitOpen(perm *ssh.Permissions, hosts []string) {
+	var opens []string
+	existing, ok := perm.Extensions["permitopen"]
+	for _, host := range hosts {
+		if !ok {
+			opens = append(opens, net.JoinHostPort(host, "*"))
+			continue
+		}
+		for _, open := range strings.Split(existing, ",") {
+			h, p, err := net.SplitHostPort(open)
+			if err == nil && (h == "*" || strings.EqualFold(h, host)) {
+				opens = append(opens, net.JoinHostPort(host, p))
+			}
+		}
+	}
+	perm.Extensions["permitopen"] = strings.Join(opens, ",")
+}
+
+// maxRegistrationKeys caps the number of keys a reverse client can register.
+const maxRegistrationKeys = 1024
+
+// A registrationKey is one key entry of a reverse-client request.
+type registrationKey struct {
+	Line     string // authorized_keys line.
+	Username string // username the key is valid for, empty for the registering username.
+}
+
+// marshalRegistrationKeys encodes authorized keys for a reverse-client
+// request.
+func marshalRegistrationKeys(keys []*AuthorizedKey) []byte {
+	var blobs [][]byte
+	for _, ak := range keys {
+		blobs = append(blobs, ssh.Marshal(&registrationKey{Line: ak.String(), Username: ak.Username}))
+	}
+	return marshalBlobs(blobs)
+}
+
+// parseRegistrationKeys decodes and validates the keys of a reverse-client
+// request. Invalid entries are skipped, and reported in rejected.
+func parseRegistrationKeys(data []byte) (keys []*AuthorizedKey, rejected []string, err error) {
+	blobs, err := parseBlobs(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(blobs) > maxRegistrationKeys {
+		return nil, nil, fmt.Errorf("too many keys, at most %d are allowed", maxRegistrationKeys)
+	}
+	seen := make(map[string]bool)
+	for i, blob := range blobs {
+		var rk registrationKey
+		if err := ssh.Unmarshal(blob, &rk); err != nil {
+			rejected = append(rejected, fmt.Sprintf("key %d: %s", i+1, err))
+			continue
+		}
+		if rk.Username != "" && !validUsername(rk.Username) {
+			rejected = append(rejected, fmt.Sprintf("key %d: invalid username %q", i+1, rk.Username))
+			continue
+		}
+		ak, err := ParseAuthorizedKeyLine(rk.Line)
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("key %d: %s", i+1, err))
+			continue
+		}
+		ak.Username = rk.Username
+		id := rk.Username + " " + ak.String()
+		if seen[id] {
+			rejected = append(rejected, fmt.Sprintf("key %d: duplicate of an earlier key", i+1))
+			continue
+		}
+		seen[id] = true
+		keys = append(keys, ak)
+	}
+	return keys, rejected, nil
+}
+
+func validUsername(username string) bool {
+	if username == "" || len(username) > 64 || username == "." || username == ".." {
+		return false
+	}
+	for _, r := range username {
+		if r <= ' ' || r == 0x7f || strings.ContainsRune("/\\:,\"'", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// userAuthorizedKeys returns the keys valid for username. The server only
+// accepts keys for the registering user, so the keys of other users, such as
+// those in authorized_keys.d, are not sent.
+func userAuthorizedKeys(keys []*AuthorizedKey, username string) []*AuthorizedKey {
+	var list []*AuthorizedKey
+	for _, ak := range keys {
+		if ak.Username == "" || ak.Username == username {
+			list = append(list, ak)
+		}
+	}
+	return list
+}
+
+// An AuthorizedKeysLister is a KeyManager that can list the authorized keys
+// it hands to the server when registering as a reverse client, with their
+// options, comments and usernames.
+type AuthorizedKeysLister interface {
+	ListAuthorizedKeys() ([]*AuthorizedKey, error)
+}
+
+// listAuthorizedKeys returns the authorized keys of km, with their options if
+// it supports it. Otherwise only the keys of GetAuthorizedKeys are listed,
+// which leaves out keys with options.
+func listAuthorizedKeys(km KeyManager) ([]*AuthorizedKey, error) {
+	if lister, ok := km.(AuthorizedKeysLister); ok {
+		return lister.ListAuthorizedKeys()
+	}
+	var keys []*AuthorizedKey
+	for _, key := range km.GetAuthorizedKeys() {
+		keys = append(keys, &AuthorizedKey{Key: key})
+	}
+	return keys, nil
+}
@@ -0,0 +1,100 @@
+package revssh
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testAddr string
+
+func (a testAddr) Network() string { return "tcp" }
+func (a testAddr) String() string  { return string(a) }
+
+func TestParseAuthorizedKeyLine(t *testing.T) {
+	signer, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	tests := []struct {
+		line        string
+		wantOptions []string
+		wantComment string
+		wantErr     bool
+	}{
+		{line: key, wantOptions: nil},
+		{line: key + " alice@laptop", wantComment: "alice@laptop"},
+		{line: `restrict,permitopen="db:5432" ` + key + " db", wantOptions: []string{"restrict", `permitopen="db:5432"`}, wantComment: "db"},
+		{line: `from="10.0.0.0/8,!10.1.2.3",no-pty ` + key, wantOptions: []string{`from="10.0.0.0/8,!10.1.2.3"`, "no-pty"}},
+		{line: `expiry-time="20300102" ` + key, wantOptions: []string{`expiry-time="20300102"`}},
+		{line: `cert-authority,principals="alice" ` + key, wantOptions: []string{"cert-authority", `principals="alice"`}},
+		{line: `command="/bin/true" ` + key, wantErr: true},
+		{line: `expiry-time="tomorrow" ` + key, wantErr: true},
+		{line: `principals="alice" ` + key, wantErr: true},
+		{line: key + "\n" + key, wantErr: true},
+		{line: "ssh-ed25519 AAAAbogus", wantErr: true},
+		{line: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		ak, err := ParseAuthorizedKeyLine(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAuthorizedKeyLine(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !equalStrings(ak.Options, tt.wantOptions) || ak.Comment != tt.wantComment {
+			t.Errorf("ParseAuthorizedKeyLine(%q) = options %q comment %q, want %q %q", tt.line, ak.Options, ak.Comment, tt.wantOptions, tt.wantComment)
+		}
+		again, err := ParseAuthorizedKeyLine(ak.String())
+		if err != nil || again.String() != ak.String() {
+			t.Errorf("round trip of %q = %v, %v", tt.line, again, err)
+		}
+	}
+}
+
+func TestMatchFrom(t *testing.T) {
+	tests := []struct {
+		patterns, remote string
+		want             bool
+	}{
+		{"10.0.0.0/8", "10.2.3.4:22", true},
+		{"10.0.0.0/8", "192.168.0.1:22", false},
+		{"10.0.0.0/8,!10.1.2.3", "10.1.2.3:22", false},
+		{"10.0.0.0/8,!10.1.2.3", "10.1.2.4:22", true},
+		{"!10.1.2.3,10.0.0.0/8", "10.1.2.3:22", false},
+		{"192.168.1.*", "192.168.1.77:22", true},
+		{"192.168.1.?", "192.168.1.77:22", false},
+		{"192.168.1.?", "192.168.1.7:22", true},
+		{"2001:db8::/32", "[2001:db8::1]:22", true},
+		{"*", "[::1]:22", true},
+		{"!10.1.2.3", "10.9.9.9:22", false},
+		{"", "10.0.0.1:22", false},
+	}
+	for _, tt := range tests {
+		if got := matchFrom(tt.patterns, testAddr(tt.remote)); got != tt.want {
+			t.Errorf("matchFrom(%q, %s) = %v, want %v", tt.patterns, tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestUserAuthorizedKeys(t *testing.T) {
+	signer, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []*AuthorizedKey
+	for _, username := range []string{"", "alice", "bob", ""} {
+		keys = append(keys, &AuthorizedKey{Key: signer.PublicKey(), Username: username})
+	}
+	var got []string
+	for _, ak := range userAuthorizedKeys(keys, "alice") {
+		got = append(got, ak.Username)
+	}
+	if want := []string{"", "alice", ""}; !equalStrings(got, want) {
+		t.Errorf("userAuthorizedKeys usernames = %q, want %q", got, want)
+	}
+}
@@ -22,6 +22,14 @@ func sessionChannelHandler(srv *Server, sshConn *ssh.ServerConn, newChan ssh.New
 		case "shell":
 			req.Reply(true, nil)
 			channel.Write([]byte(fmt.Sprintf("Welcome to %s\n\r", sshConn.User())))
+		case "exec":
+			if !srv.AllowReverse {
+				req.Reply(false, nil)
+				continue
+			}
+			execRequest(srv, sshConn, channel, req)
+			go ssh.DiscardRequests(reqs)
+			return
 		default:
 			newChan.Reject(ssh.UnknownChannelType, fmt.Sprintf("Not Implemented"))
 			req.Reply(false, nil)
@@ -22,7 +22,16 @@ func main() {
 	// settings := NewSettings()
 	// settings := revssh.NewFileClientSettings()
 	rclient := revssh.NewReverseClient()
-	rclient.Settings = revssh.NewFileClientSettings()
+	settings := revssh.NewFileClientSettings()
+	rclient.Settings = settings
+	signers, err := settings.AgentSigners()
+	if err != nil {
+		log.Fatalf("ERROR: %+v", err)
+	}
+	rclient.Signers = signers
+	rclient.OnStateChange = func(state revssh.ClientState) {
+		log.Printf("reverse client %s", state)
+	}
 
 	if err := rclient.Connect(); err != nil {
 		log.Printf("ERROR: %+v", err)
@@ -22,6 +22,19 @@ func main() {
 	sshd.Settings = settings
 	sshd.Addr = settings.Listen
 	sshd.AllowReverse = true
+	if settings.RateLimit {
+		sshd.RateLimit = revssh.NewRateLimiter()
+		sshd.RateLimit.Allowlist = settings.Allowlist
+	}
+	sshd.Limits = settings.Limits
+	sshd.ReverseKeepAliveInterval = settings.ReverseKeepAliveInterval
+	sshd.ReverseKeepAliveMax = settings.ReverseKeepAliveMax
+	sshd.HostCA = settings.HostCA
+	sshd.HostCertValidity = settings.HostCertValidity
+	sshd.VirtualDomain = settings.VirtualDomain
+	sshd.ReservedHostnames = settings.ReservedHostnames
+	sshd.ApprovalSelector = settings.ApprovalSelector
+	sshd.ApprovalTimeout = settings.ApprovalTimeout
 	if err := sshd.ServeTCP(); err != nil {
 		log.Printf("ERROR: %+v", err)
 	}
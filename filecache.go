@@ -0,0 +1,65 @@
+package revssh
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often a cached file is checked for changes.
+var pollInterval = 1 * time.Second
+
+// fileCache keeps the parsed contents of a file, and reloads it once the file
+// changes on disk. Changes are detected by polling the modification time and
+// size, at most once every pollInterval.
+type fileCache struct {
+	value   interface{}
+	loaded  bool
+	modTime time.Time
+	size    int64
+	checked time.Time
+	sync.Mutex
+}
+
+// get returns the parsed contents of the file at path, parsing it again with
+// parse if it changed. A missing file is parsed as empty. Reports whether the
+// file was reloaded.
+func (fc *fileCache) get(path string, parse func(data []byte) interface{}) (interface{}, bool, error) {
+	fc.Lock()
+	defer fc.Unlock()
+	now := time.Now()
+	if fc.loaded && now.Sub(fc.checked) < pollInterval {
+		return fc.value, false, nil
+	}
+	fc.checked = now
+	var modTime time.Time
+	var size int64
+	fi, err := os.Stat(path)
+	switch {
+	case err == nil:
+		modTime, size = fi.ModTime(), fi.Size()
+	case !os.IsNotExist(err):
+		return fc.value, false, err
+	}
+	if fc.loaded && modTime.Equal(fc.modTime) && size == fc.size {
+		return fc.value, false, nil
+	}
+	var data []byte
+	if err == nil {
+		if data, err = ioutil.ReadFile(path); err != nil && !os.IsNotExist(err) {
+			return fc.value, false, err
+		}
+	}
+	fc.value = parse(data)
+	fc.loaded = true
+	fc.modTime, fc.size = modTime, size
+	return fc.value, true, nil
+}
+
+// invalidate forces a reload on the next get, for after we wrote the file.
+func (fc *fileCache) invalidate() {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.loaded = false
+}
@@ -1,27 +1,34 @@
 package revssh
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cnf/revssh/revutil"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var (
 	keynames = []string{"ssh_host_ecdsa_key", "ssh_host_ed25519_key", "ssh_host_rsa_key"}
+	idnames  = []string{"id_ecdsa", "id_ed25519", "id_rsa"}
 )
 
 // FileClientSettings ...
@@ -30,6 +37,16 @@ type FileClientSettings struct {
 	remote   string
 	user     string
 	hostname string
+	aliases  []string
+	labels   map[string]string
+
+	keepAliveInterval time.Duration
+	keepAliveMax      int
+	backoffMin        time.Duration
+	backoffMax        time.Duration
+	maxAttempts       int
+	agentSocket       string
+	agentListen       string
 	// KeyManager *FileKeyManager
 }
 
@@ -42,8 +59,62 @@ func NewFileClientSettings() *FileClientSettings {
 	var remote = flag.String("remote", "127.0.0.1:2222", "address:port to connect")
 	var username = flag.String("user", name, "ssh user")
 	var hostname = flag.String("hostname", "", "hostname to register as")
+	var aliases = flag.String("aliases", "", "comma separated other names to register as, such as a serial number or asset tag")
+	var labelList = flag.String("labels", "", "comma separated key=value labels to register with, such as site=ams,role=edge")
+	var kaInterval = flag.Duration("keepalive", 5*time.Second, "interval between keepalives (0 disables them)")
+	var kaMax = flag.Int("keepalive-max", 5, "missed keepalives after which the connection is closed")
+	var backoffMin = flag.Duration("backoff-min", 100*time.Millisecond, "minimum delay between reconnects")
+	var backoffMax = flag.Duration("backoff-max", 1*time.Minute, "maximum delay between reconnects")
+	var maxAttempts = flag.Int("max-attempts", 0, "give up after this many failed connection attempts (0 retries forever)")
+	var checking = flag.String("hostkey-checking", "accept-new", "host key checking mode: strict, accept-new, ask or off")
+	var pins = flag.String("pin", "", "comma separated SHA256 fingerprints of accepted server host keys")
+	var passFile = flag.String("passphrase-file", "", "file holding the passphrase of encrypted private keys")
+	var agentSocket = flag.String("agent", "", "ssh-agent socket to authenticate with, \"env\" uses SSH_AUTH_SOCK")
+	var agentListen = flag.String("agent-listen", "", "serve an in-process ssh-agent on this socket, and authenticate with its keys")
 	flag.Parse()
-	return &FileClientSettings{remote: *remote, user: *username, hostname: *hostname, KeyManager: &FileKeyManager{path: *path}}
+	km := &FileKeyManager{path: *path, Passphrase: defaultPassphrase(*passFile)}
+	var names []string
+	for _, alias := range strings.Split(*aliases, ",") {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			names = append(names, alias)
+		}
+	}
+	var list []string
+	for _, label := range strings.Split(*labelList, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			list = append(list, label)
+		}
+	}
+	labels, err := ParseLabels(list)
+	if err != nil {
+		log.Printf("ERROR: %+v", err)
+	}
+	mode, err := ParseHostKeyChecking(*checking)
+	if err != nil {
+		log.Printf("ERROR: %+v", err)
+		mode = Strict
+	}
+	km.HostKeyChecking = mode
+	for _, pin := range strings.Split(*pins, ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			km.PinnedKeys = append(km.PinnedKeys, pin)
+		}
+	}
+	return &FileClientSettings{
+		remote:            *remote,
+		user:              *username,
+		hostname:          *hostname,
+		aliases:           names,
+		labels:            labels,
+		keepAliveInterval: *kaInterval,
+		keepAliveMax:      *kaMax,
+		backoffMin:        *backoffMin,
+		backoffMax:        *backoffMax,
+		maxAttempts:       *maxAttempts,
+		agentSocket:       *agentSocket,
+		agentListen:       *agentListen,
+		KeyManager:        km,
+	}
 
 }
 
@@ -70,10 +141,108 @@ func (s *FileClientSettings) Hostname() string {
 	return s.hostname
 }
 
+func (s *FileClientSettings) Aliases() []string {
+	return s.aliases
+}
+
+func (s *FileClientSettings) Labels() map[string]string {
+	return s.labels
+}
+
+func (s *FileClientSettings) KeepAliveInterval() time.Duration {
+	return s.keepAliveInterval
+}
+
+func (s *FileClientSettings) KeepAliveMax() int {
+	return s.keepAliveMax
+}
+
+func (s *FileClientSettings) BackoffMin() time.Duration {
+	return s.backoffMin
+}
+
+func (s *FileClientSettings) BackoffMax() time.Duration {
+	return s.backoffMax
+}
+
+func (s *FileClientSettings) MaxAttempts() int {
+	return s.maxAttempts
+}
+
+// ListAuthorizedKeys returns the authorized keys of the KeyManager, with their
+// options if it supports it.
+func (s *FileClientSettings) ListAuthorizedKeys() ([]*AuthorizedKey, error) {
+	return listAuthorizedKeys(s.KeyManager)
+}
+
+// GetIdentityKeys returns the identity keys of the KeyManager, or its private
+// keys if it doesn't keep identity keys apart.
+func (s *FileClientSettings) GetIdentityKeys() []ssh.Signer {
+	return identityKeys(s.KeyManager)
+}
+
+// AgentSigners returns the agent signers configured with the -agent or
+// -agent-listen flags, or nil if no agent is configured. With -agent-listen
+// an in-process agent is started.
+func (s *FileClientSettings) AgentSigners() (func() ([]ssh.Signer, error), error) {
+	if s.agentListen != "" {
+		keyring := agent.NewKeyring()
+		if _, err := ServeAgent(keyring, s.agentListen); err != nil {
+			return nil, err
+		}
+		return keyring.Signers, nil
+	}
+	switch s.agentSocket {
+	case "":
+		return nil, nil
+	case "env":
+		return AgentSigners(""), nil
+	}
+	return AgentSigners(s.agentSocket), nil
+}
+
+// KnownHostKeys returns the public keys known for hostname, if the KeyManager
+// supports it.
+func (s *FileClientSettings) KnownHostKeys(hostname string) ([]ssh.PublicKey, error) {
+	updater, ok := s.KeyManager.(KnownHostsUpdater)
+	if !ok {
+		return nil, errors.New("key manager can't update known hosts")
+	}
+	return updater.KnownHostKeys(hostname)
+}
+
+// UpdateKnownHost replaces the public keys known for hostname, if the
+// KeyManager supports it.
+func (s *FileClientSettings) UpdateKnownHost(hostname string, keys []ssh.PublicKey) error {
+	updater, ok := s.KeyManager.(KnownHostsUpdater)
+	if !ok {
+		return errors.New("key manager can't update known hosts")
+	}
+	return updater.UpdateKnownHost(hostname, keys)
+}
+
 // FileServerSettings ...
 type FileServerSettings struct {
 	KeyManager
-	Listen string
+	Listen    string
+	RateLimit bool         // limit connections and failed authentications per source address, and delay failed logins per user.
+	Allowlist []*net.IPNet // source addresses exempt from rate limiting.
+	Limits    Limits
+
+	ReverseKeepAliveInterval time.Duration
+	ReverseKeepAliveMax      int
+	HostCA                   ssh.Signer // signs host certificates for reverse clients, if set.
+	HostCertValidity         time.Duration
+	VirtualDomain            string
+	ReservedHostnames        []string
+	ApprovalSelector         Selector
+	ApprovalTimeout          time.Duration
+
+	path    string
+	aliases fileCache
+	labels  fileCache
+	acl     fileCache
+	users   fileCache
 	// path       string
 	// KeyManager *FileKeyManager
 }
@@ -85,16 +254,216 @@ func NewFileServerSettings() *FileServerSettings {
 	cdpath, _ := filepath.Abs(dpath)
 	// var path = flag.String("path", cdpath, "configuration path")
 	var listen = flag.String("listen", ":22", "address:port to listen on")
+	var rateLimit = flag.Bool("rate-limit", false, "ban source addresses making too many connections or failed authentications, and slow down failed logins per user")
+	var allowlist = flag.String("allowlist", "", "comma separated addresses and networks exempt from rate limiting")
+	var limits Limits
+	flag.IntVar(&limits.MaxConnections, "max-conns", 0, "maximum concurrent connections (0 is unlimited)")
+	flag.IntVar(&limits.MaxConnectionsPerUser, "max-user-conns", 0, "maximum concurrent connections per user (0 is unlimited)")
+	flag.IntVar(&limits.MaxChannelsPerConn, "max-channels", 0, "maximum concurrent channels per connection (0 is unlimited)")
+	flag.IntVar(&limits.MaxReverseClientsPerKey, "max-reverse-per-key", 0, "maximum reverse clients registered per key (0 is unlimited)")
+	flag.DurationVar(&limits.HandshakeTimeout, "handshake-timeout", 2*time.Minute, "time a client gets to authenticate (0 is unlimited)")
+	flag.DurationVar(&limits.IdleTimeout, "idle-timeout", 0, "disconnect peers silent for this long, keepalives are sent after a third (0 is unlimited)")
+	var rkaInterval = flag.Duration("reverse-keepalive", 15*time.Second, "interval between keepalives to reverse clients (0 disables them)")
+	var rkaMax = flag.Int("reverse-keepalive-max", 3, "missed keepalives after which a reverse client is evicted")
+	var keysCommand = flag.String("authorized-keys-command", "", "command printing the authorized keys of a user, %u is replaced by the username")
+	var passFile = flag.String("passphrase-file", "", "file holding the passphrase of encrypted private keys")
+	var hostCA = flag.String("host-ca", "", "CA private key signing host certificates for reverse clients, needs -virtual-domain")
+	var certValidity = flag.Duration("host-cert-validity", 24*time.Hour, "lifetime of host certificates")
+	var domain = flag.String("virtual-domain", "", "domain reverse clients are reachable in, as in host.<domain>")
+	var reserved = flag.String("reserved-hostnames", strings.Join(DefaultReservedHostnames, ","), "comma separated hostnames reverse clients can't register")
+	var approval = flag.String("approval-selector", "", "label selector, matched against the labels file, of reverse clients forwarding to needs the approval of another admin")
+	var approvalTimeout = flag.Duration("approval-timeout", 5*time.Minute, "time an admin gets to approve forwarding")
 	flag.Parse()
 	// s.path = *path
 	// s.path = cdpath
 	// s.Listen = *listen
-	return &FileServerSettings{Listen: *listen, KeyManager: &FileKeyManager{path: cdpath}}
+	sel, err := ParseSelector(*approval)
+	if err != nil {
+		log.Printf("ERROR: %+v", err)
+	}
+	nets, err := ParseAllowlist(*allowlist)
+	if err != nil {
+		log.Printf("ERROR: %+v", err)
+	}
+	km := &FileKeyManager{
+		path:                  cdpath,
+		AuthorizedKeysCommand: *keysCommand,
+		Passphrase:            defaultPassphrase(*passFile),
+	}
+	var ca ssh.Signer
+	if *hostCA != "" {
+		ca, err = km.loadPrivateKey(*hostCA)
+		if err != nil {
+			log.Printf("ERROR: can't load host CA: %+v", err)
+		}
+	}
+	return &FileServerSettings{
+		Listen:                   *listen,
+		RateLimit:                *rateLimit,
+		Allowlist:                nets,
+		Limits:                   limits,
+		ReverseKeepAliveInterval: *rkaInterval,
+		ReverseKeepAliveMax:      *rkaMax,
+		HostCA:                   ca,
+		HostCertValidity:         *certValidity,
+		VirtualDomain:            *domain,
+		ReservedHostnames:        strings.Split(*reserved, ","),
+		ApprovalSelector:         sel,
+		ApprovalTimeout:          *approvalTimeout,
+		KeyManager:               km,
+		path:                     cdpath,
+	}
+}
+
+// GetAliases returns the aliases configured for hostname in the aliases file,
+// which lists a hostname followed by its aliases on every line.
+func (s *FileServerSettings) GetAliases(hostname string) []string {
+	path := filepath.Join(s.path, "aliases")
+	v, _, err := s.aliases.get(path, func(data []byte) interface{} {
+		return parseAliases(path, data)
+	})
+	if err != nil {
+		log.Printf("ERROR: %+v", err)
+	}
+	aliases, _ := v.(map[string][]string)
+	return aliases[hostname]
+}
+
+// GetLabels returns the labels assigned to hostname in the labels file, which
+// lists a hostname followed by its key=value labels on every line.
+func (s *FileServerSettings) GetLabels(hostname string) map[string]string {
+	path := filepath.Join(s.path, "labels")
+	v, _, err := s.labels.get(path, func(data []byte) interface{} {
+		return parseLabelsFile(path, data)
+	})
+	if err != nil {
+		log.Printf("ERROR: %+v", err)
+	}
+	labels, _ := v.(map[string]map[string]string)
+	return labels[hostname]
+}
+
+// RecordApproval appends a decision on an approval request to the
+// approvals.log file.
+func (s *FileServerSettings) RecordApproval(record string) error {
+	return revutil.AppendLine(filepath.Join(s.path, "approvals.log"), record)
+}
+
+// CanAccess checks the rules of the acl file, see ParseACL.
+func (s *FileServerSettings) CanAccess(user *User, key ssh.PublicKey, rc *ReverseClientHandler) bool {
+	return s.loadACL().CanAccess(user, key, rc)
+}
+
+// InGroup reports whether user is a member of group, by its own groups or the
+// groups of the acl file.
+func (s *FileServerSettings) InGroup(user *User, group string) bool {
+	return s.loadACL().InGroup(user, group)
+}
+
+func (s *FileServerSettings) loadACL() *ACL {
+	path := filepath.Join(s.path, "acl")
+	v, _, err := s.acl.get(path, func(data []byte) interface{} {
+		return ParseACL(path, data)
+	})
+	if err != nil {
+		log.Printf("ERROR: %+v", err)
+	}
+	acl, _ := v.(*ACL)
+	return acl
+}
+
+// GetUser returns the user called name from the users file, see ParseUsers.
+func (s *FileServerSettings) GetUser(name string) *User {
+	return s.loadUsers().GetUser(name)
+}
+
+func (s *FileServerSettings) loadUsers() Users {
+	path := filepath.Join(s.path, "users")
+	v, _, err := s.users.get(path, func(data []byte) interface{} {
+		return ParseUsers(path, data)
+	})
+	if err != nil {
+		log.Printf("ERROR: %+v", err)
+	}
+	users, _ := v.(Users)
+	return users
+}
+
+// HasUserKeys reports whether the users file defines users, or the KeyManager
+// has keys set up per user.
+func (s *FileServerSettings) HasUserKeys() bool {
+	if len(s.loadUsers()) > 0 {
+		return true
+	}
+	ukm, ok := s.KeyManager.(UserKeyManager)
+	return ok && ukm.HasUserKeys()
+}
+
+// LoadGrants reads the grants file, with a grant on every line, see
+// ParseGrant.
+func (s *FileServerSettings) LoadGrants() ([]*Grant, error) {
+	path := filepath.Join(s.path, "grants")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var grants []*Grant
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		g, err := ParseGrant(line)
+		if err != nil {
+			log.Printf("ERROR: %s:%d: %s, skipping", path, i+1, err)
+			continue
+		}
+		grants = append(grants, g)
+	}
+	return grants, nil
+}
+
+// SaveGrants replaces the grants file.
+func (s *FileServerSettings) SaveGrants(grants []*Grant) error {
+	var lines []string
+	for _, g := range grants {
+		lines = append(lines, g.String())
+	}
+	return revutil.WriteLines(filepath.Join(s.path, "grants"), lines)
+}
+
+// GetRetiringKeys returns the host keys being rotated out, if the KeyManager
+// supports it.
+func (s *FileServerSettings) GetRetiringKeys() []ssh.Signer {
+	if rotator, ok := s.KeyManager.(HostKeyRotator); ok {
+		return rotator.GetRetiringKeys()
+	}
+	return nil
 }
 
 // FileKeyManager ...
 type FileKeyManager struct {
-	path string
+	reloads uint64 // first field, to keep it 64-bit aligned for atomic access.
+
+	HostKeyChecking HostKeyChecking // how unknown and changed host keys are handled.
+	PinnedKeys      []string        // if set, only host keys with these SHA256 fingerprints are accepted.
+	// AuthorizedKeysCommand is run to look up the keys of a user, with %u
+	// replaced by the username, or the username as last argument.
+	AuthorizedKeysCommand string
+	// Passphrase is asked for the passphrase of encrypted private keys.
+	Passphrase revutil.PassphraseFunc
+
+	path           string
+	authorizedKeys fileCache
+	knownHosts     fileCache
+	userKeys       map[string]*fileCache
+	userKeysMu     sync.Mutex
+	privateKeys    map[string]*fileCache
+	privateKeysMu  sync.Mutex
+	generateMu     sync.Mutex
 }
 
 // NewFileKeyManager ...
@@ -102,54 +471,341 @@ func NewFileKeyManager(path string) *FileKeyManager {
 	return &FileKeyManager{path: path}
 }
 
-// GetPublicKeys returns all publickeys for a specific username.
+// GetPublicKeys returns all publickeys for a specific username, read from
+// authorized_keys.d/<username>, and from the output of AuthorizedKeysCommand,
+// if set.
 func (km *FileKeyManager) GetPublicKeys(username string) ([]ssh.PublicKey, error) {
-	return nil, nil
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, "/\\\x00") {
+		return nil, fmt.Errorf("invalid username: %q", username)
+	}
+	km.userKeysMu.Lock()
+	if km.userKeys == nil {
+		km.userKeys = make(map[string]*fileCache)
+	}
+	fc, ok := km.userKeys[username]
+	if !ok {
+		fc = &fileCache{}
+		km.userKeys[username] = fc
+	}
+	km.userKeysMu.Unlock()
+	path := filepath.Join(km.path, "authorized_keys.d", username)
+	v, reloaded, err := fc.get(path, func(data []byte) interface{} {
+		return parseAuthorizedKeys(path, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reloaded {
+		atomic.AddUint64(&km.reloads, 1)
+	}
+	keys, _ := v.([]ssh.PublicKey)
+	if len(keys) == 0 {
+		// don't let unknown usernames grow the cache.
+		km.userKeysMu.Lock()
+		delete(km.userKeys, username)
+		km.userKeysMu.Unlock()
+	}
+	if km.AuthorizedKeysCommand == "" {
+		return keys, nil
+	}
+	cmdKeys, err := km.runAuthorizedKeysCommand(username)
+	if err != nil {
+		log.Printf("ERROR: authorized keys command for %s: %+v", username, err)
+		return keys, nil
+	}
+	return append(append([]ssh.PublicKey(nil), keys...), cmdKeys...), nil
+}
+
+// HasUserKeys reports whether an AuthorizedKeysCommand is set, or an
+// authorized_keys.d directory exists.
+func (km *FileKeyManager) HasUserKeys() bool {
+	if km.AuthorizedKeysCommand != "" {
+		return true
+	}
+	fi, err := os.Stat(filepath.Join(km.path, "authorized_keys.d"))
+	return err == nil && fi.IsDir()
+}
+
+// safeUsername reports whether username can be passed to the
+// AuthorizedKeysCommand: letters, digits, '.', '_', '-' and '@', not starting
+// with a '-' or '.', so it can't be taken for an option.
+func safeUsername(username string) bool {
+	if username == "" || len(username) > 64 || username[0] == '-' || username[0] == '.' {
+		return false
+	}
+	for _, r := range username {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '_', r == '-', r == '@':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// runAuthorizedKeysCommand runs AuthorizedKeysCommand, with %u replaced by the
+// username, or the username appended if there is no %u, and parses its output
+// as authorized_keys. Usernames that aren't safeUsername are refused.
+func (km *FileKeyManager) runAuthorizedKeysCommand(username string) ([]ssh.PublicKey, error) {
+	if !safeUsername(username) {
+		return nil, fmt.Errorf("refusing to look up unsafe username %q", username)
+	}
+	args := strings.Fields(km.AuthorizedKeysCommand)
+	found := false
+	for i := range args {
+		if strings.Contains(args[i], "%u") {
+			args[i] = strings.Replace(args[i], "%u", username, -1)
+			found = true
+		}
+	}
+	if !found {
+		args = append(args, username)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseAuthorizedKeys(km.AuthorizedKeysCommand, out), nil
 }
 
 // GetAuthorizedKeys returns all public keys that are authorized to connect to this server.
+// The authorized_keys file is cached, and reloaded once it changes.
 func (km *FileKeyManager) GetAuthorizedKeys() []ssh.PublicKey {
-	// TODO: actually reading authorized_keys
-	var keys []ssh.PublicKey
-
-	file, err := os.Open(km.getAuthorizedKeysPath())
+	path := km.getAuthorizedKeysPath()
+	v, reloaded, err := km.authorizedKeys.get(path, func(data []byte) interface{} {
+		return parseAuthorizedKeys(path, data)
+	})
 	if err != nil {
 		log.Printf("ERROR: %+v", err)
-		return nil
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		// log.Println(scanner.Text())
-		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(scanner.Text()))
+	if reloaded {
+		atomic.AddUint64(&km.reloads, 1)
+	}
+	keys, _ := v.([]ssh.PublicKey)
+	return keys
+}
+
+// parseAuthorizedKeys parses authorized_keys data, skipping and reporting bad
+// lines. Lines with options are skipped too, only ListAuthorizedKeys keeps
+// them, and a plain key would grant more than the line allows.
+func parseAuthorizedKeys(path string, data []byte) []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
 		if err != nil {
-			log.Printf("ERROR: %+v", err)
-			return nil
+			log.Printf("ERROR: %s:%d: %+v, skipping", path, i+1, err)
+			continue
+		}
+		if len(options) > 0 {
+			log.Printf("%s:%d: key options are not supported here, skipping", path, i+1)
+			continue
 		}
 		keys = append(keys, key)
 	}
 	return keys
 }
 
+// ListAuthorizedKeys returns the keys from authorized_keys, and from the
+// files in authorized_keys.d for their username, with options and comments.
+func (km *FileKeyManager) ListAuthorizedKeys() ([]*AuthorizedKey, error) {
+	keys, err := readAuthorizedKeyLines(km.getAuthorizedKeysPath(), "")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	dir := filepath.Join(km.path, "authorized_keys.d")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		userKeys, err := readAuthorizedKeyLines(filepath.Join(dir, fi.Name()), fi.Name())
+		if err != nil {
+			log.Printf("ERROR: %+v", err)
+			continue
+		}
+		keys = append(keys, userKeys...)
+	}
+	return keys, nil
+}
+
+func readAuthorizedKeyLines(path, username string) ([]*AuthorizedKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*AuthorizedKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ak, err := ParseAuthorizedKeyLine(line)
+		if err != nil {
+			log.Printf("ERROR: %s:%d: %+v, skipping", path, i+1, err)
+			continue
+		}
+		ak.Username = username
+		keys = append(keys, ak)
+	}
+	return keys, nil
+}
+
+// Reloads returns how many times the authorized_keys and known_hosts files
+// were (re)loaded.
+func (km *FileKeyManager) Reloads() uint64 {
+	return atomic.LoadUint64(&km.reloads)
+}
+
 // IsKnownHost , like a ssh.HostKeyCallback, must return nil if the host key is OK,
-// or an error to reject it. If no entry is found, it will add it.
+// or an error to reject it. Pinned fingerprints take precedence over the
+// known_hosts file. Unknown and changed keys are handled as set by
+// HostKeyChecking, rejected keys result in a *HostKeyError.
 func (km *FileKeyManager) IsKnownHost(hostname string, remote net.Addr, key ssh.PublicKey) error {
-	khkb, err := knownhosts.New(km.getKnownHostPath())
-	if err != nil {
-		// if strings.HasSuffix(err.Error(), "no such file or directory") || strings.HasSuffix(err.Error(), "The system cannot find the file specified") {
-		if os.IsNotExist(err) {
-			return revutil.AppendLine(km.getKnownHostPath(), knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	fingerprint := ssh.FingerprintSHA256(key)
+	if len(km.PinnedKeys) > 0 {
+		for _, pin := range km.PinnedKeys {
+			if pin == fingerprint {
+				return nil
+			}
+		}
+		return &HostKeyError{Hostname: hostname, Fingerprint: fingerprint, Reason: "does not match any pinned fingerprint"}
+	}
+	khkb, err := km.knownHostsCallback()
+	if err == nil {
+		err = khkb(hostname, remote, key)
+	}
+	var keyErr *knownhosts.KeyError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+		if km.HostKeyChecking == NoChecking {
+			return nil
+		}
+		want := keyErr.Want[0]
+		return &HostKeyError{
+			Hostname:    hostname,
+			Fingerprint: fingerprint,
+			Reason:      fmt.Sprintf("does not match known key %s in %s", ssh.FingerprintSHA256(want.Key), km.getKnownHostPath()),
 		}
+	case errors.As(err, &keyErr), os.IsNotExist(err):
+		// unknown key
+	default:
 		return err
 	}
-	err = khkb(hostname, remote, key)
+	switch km.HostKeyChecking {
+	case Strict:
+		return &HostKeyError{Hostname: hostname, Fingerprint: fingerprint, Reason: "is unknown", Unknown: true}
+	case Ask:
+		if !askHostKey(hostname, fingerprint) {
+			return &HostKeyError{Hostname: hostname, Fingerprint: fingerprint, Reason: "was not accepted"}
+		}
+	}
+	// TODO: do we need to add remote net.Addr as one of the hostnames?
+	defer km.knownHosts.invalidate()
+	return revutil.AppendLine(km.getKnownHostPath(), knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+}
+
+// knownHostsCallback returns a cached callback for the known_hosts file,
+// rebuilt once the file changes.
+func (km *FileKeyManager) knownHostsCallback() (ssh.HostKeyCallback, error) {
+	path := km.getKnownHostPath()
+	v, reloaded, err := km.knownHosts.get(path, func(data []byte) interface{} {
+		return parseKnownHosts(path, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reloaded {
+		atomic.AddUint64(&km.reloads, 1)
+	}
+	cb, ok := v.(ssh.HostKeyCallback)
+	if !ok {
+		return nil, errors.New("no known hosts callback")
+	}
+	return cb, nil
+}
+
+// parseKnownHosts builds a callback from known_hosts data, skipping and
+// reporting bad lines.
+func parseKnownHosts(path string, data []byte) interface{} {
+	return parseKnownHostsDB(path, data).callback()
+}
+
+// KnownHostKeys returns the public keys known for hostname. Hashed entries
+// and entries with markers are not considered.
+func (km *FileKeyManager) KnownHostKeys(hostname string) ([]ssh.PublicKey, error) {
+	lines, err := km.readKnownHosts()
 	if err != nil {
-		if os.IsNotExist(err) || strings.HasSuffix(err.Error(), "knownhosts: key is unknown") {
-			// TODO: do we need to add remote net.Addr as one of the hostnames?
-			return revutil.AppendLine(km.getKnownHostPath(), knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for _, line := range lines {
+		if key := knownHostKey(line, hostname); key != nil {
+			keys = append(keys, key)
 		}
+	}
+	return keys, nil
+}
+
+// UpdateKnownHost replaces the public keys known for hostname.
+func (km *FileKeyManager) UpdateKnownHost(hostname string, keys []ssh.PublicKey) error {
+	lines, err := km.readKnownHosts()
+	if err != nil {
 		return err
 	}
+	var out []string
+	for _, line := range lines {
+		if knownHostKey(line, hostname) == nil {
+			out = append(out, line)
+		}
+	}
+	for _, key := range keys {
+		out = append(out, knownhosts.Line([]string{hostname}, key))
+	}
+	defer km.knownHosts.invalidate()
+	return revutil.WriteLines(km.getKnownHostPath(), out)
+}
+
+func (km *FileKeyManager) readKnownHosts() ([]string, error) {
+	data, err := ioutil.ReadFile(km.getKnownHostPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// knownHostKey returns the key of a known_hosts line, if it is a plain entry
+// for hostname.
+func knownHostKey(line, hostname string) ssh.PublicKey {
+	marker, hosts, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+	if err != nil || marker != "" {
+		return nil
+	}
+	for _, host := range hosts {
+		if host == hostname {
+			return key
+		}
+	}
 	return nil
 }
 
@@ -164,22 +820,26 @@ func (km *FileKeyManager) getAuthorizedKeysPath() string {
 }
 
 // GetPrivateKeys returns a list of signers.
-// If no private keys are available, one should be created.
+// Missing ssh_host_*_key files are generated.
 func (km *FileKeyManager) GetPrivateKeys() []ssh.Signer {
 	path, err := getConfigDir(km.path)
 	if err != nil {
-		log.Panicf("ERROR: can't get config dir: %s", err)
+		log.Printf("ERROR: can't get config dir: %s", err)
+		return nil
 	}
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
-		log.Panicf("ERROR: can't get config dir: %s", err)
+		log.Printf("ERROR: can't read config dir: %s", err)
+		return nil
 	}
 	sort.Strings(keynames)
 	hostKeys := make([]ssh.Signer, 0)
+	found := make(map[string]bool)
 	for fi := range files {
 		ki := sort.SearchStrings(keynames, files[fi].Name())
 		if ki < len(keynames) && keynames[ki] == files[fi].Name() {
-			hostKey, err := revutil.ParsePrivateKeyFile(fmt.Sprintf("%s/%s", path, files[fi].Name()))
+			found[files[fi].Name()] = true
+			hostKey, err := km.loadPrivateKey(filepath.Join(path, files[fi].Name()))
 			if err != nil {
 				log.Printf("%+v", err)
 				continue
@@ -187,12 +847,168 @@ func (km *FileKeyManager) GetPrivateKeys() []ssh.Signer {
 			hostKeys = append(hostKeys, hostKey)
 		}
 	}
+	for _, name := range keynames {
+		if found[name] {
+			continue
+		}
+		hostKey, err := km.generateMissingKey(filepath.Join(path, name))
+		if err != nil {
+			log.Printf("ERROR: can't generate %s: %s", name, err)
+			continue
+		}
+		hostKeys = append(hostKeys, hostKey)
+	}
 	return hostKeys
 }
 
+// GetIdentityKeys returns the signers a client authenticates with, read from
+// the id_ecdsa, id_ed25519 and id_rsa files. If there are none, the host keys
+// are used when they exist, as older versions authenticated with those, with a
+// warning on how to migrate, see the README. Otherwise an id_ed25519 key is
+// generated.
+func (km *FileKeyManager) GetIdentityKeys() []ssh.Signer {
+	path, err := getConfigDir(km.path)
+	if err != nil {
+		log.Printf("ERROR: can't get config dir: %s", err)
+		return nil
+	}
+	var keys []ssh.Signer
+	found := false
+	for _, name := range idnames {
+		if _, err := os.Stat(filepath.Join(path, name)); err != nil {
+			continue
+		}
+		found = true
+		key, err := km.loadPrivateKey(filepath.Join(path, name))
+		if err != nil {
+			log.Printf("%+v", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if found {
+		return keys
+	}
+	for _, name := range keynames {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			log.Printf("WARNING: no identity keys in %s, authenticating with the host keys of the embedded sshd. "+
+				"Generate %s, authorize its public key on the server and restart to stop sharing them.",
+				path, filepath.Join(path, "id_ed25519"))
+			return km.GetPrivateKeys()
+		}
+	}
+	key, err := km.generateMissingKey(filepath.Join(path, "id_ed25519"))
+	if err != nil {
+		log.Printf("ERROR: can't generate id_ed25519: %s", err)
+		return nil
+	}
+	return []ssh.Signer{key}
+}
+
+// generateMissingKey generates the key at path, or loads it if it exists by
+// now. Generating is serialized, so connections coming in on a first start
+// don't race each other to generate the same key.
+func (km *FileKeyManager) generateMissingKey(path string) (ssh.Signer, error) {
+	km.generateMu.Lock()
+	defer km.generateMu.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		return km.loadPrivateKey(path)
+	}
+	signer, err := generateKey(path)
+	if os.IsExist(err) {
+		// another process generated it in the meantime.
+		return km.loadPrivateKey(path)
+	}
+	return signer, err
+}
+
+// generateKey generates a key at path, its type taken from the file name as in
+// "ssh_host_<type>_key" or "id_<type>".
+func generateKey(path string) (ssh.Signer, error) {
+	name := filepath.Base(path)
+	keytype := strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(name, "ssh_host_"), "_key"), "id_")
+	comment := ""
+	if cuser, err := user.Current(); err == nil {
+		comment = cuser.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		comment += "@" + hostname
+	}
+	signer, err := revutil.GenerateKeyFile(path, keytype, comment)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Generated %s: %s", name, ssh.FingerprintSHA256(signer.PublicKey()))
+	return signer, nil
+}
+
+// GetRetiringKeys returns the host keys being rotated out, read from
+// ssh_host_*_key.retiring files.
+func (km *FileKeyManager) GetRetiringKeys() []ssh.Signer {
+	var keys []ssh.Signer
+	for _, name := range keynames {
+		path := filepath.Join(km.path, name+".retiring")
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		key, err := km.loadPrivateKey(path)
+		if err != nil {
+			log.Printf("%+v", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// loadPrivateKey returns the private key at path. Keys are cached, so the
+// passphrase of an encrypted key is only asked again when the file changes.
+func (km *FileKeyManager) loadPrivateKey(path string) (ssh.Signer, error) {
+	km.privateKeysMu.Lock()
+	if km.privateKeys == nil {
+		km.privateKeys = make(map[string]*fileCache)
+	}
+	fc, ok := km.privateKeys[path]
+	if !ok {
+		fc = &fileCache{}
+		km.privateKeys[path] = fc
+	}
+	km.privateKeysMu.Unlock()
+	v, _, err := fc.get(path, func(data []byte) interface{} {
+		signer, err := revutil.ParsePrivateKeyWithPassphrase(data, path, km.Passphrase)
+		if err != nil {
+			return err
+		}
+		return signer
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch key := v.(type) {
+	case ssh.Signer:
+		return key, nil
+	case error:
+		// parse again next time, the passphrase may be right by then.
+		fc.invalidate()
+		return nil, key
+	}
+	return nil, fmt.Errorf("no key in %s", path)
+}
+
+// defaultPassphrase looks for passphrases in the REVSSH_PASSPHRASE environment
+// variable, the passphrase file if set, the revssh-passphrase systemd
+// credential, and finally asks on the terminal.
+func defaultPassphrase(file string) revutil.PassphraseFunc {
+	fns := []revutil.PassphraseFunc{revutil.EnvPassphrase("REVSSH_PASSPHRASE")}
+	if file != "" {
+		fns = append(fns, revutil.FilePassphrase(file))
+	}
+	return revutil.FirstPassphrase(append(fns, revutil.CredentialPassphrase("revssh-passphrase"), revutil.PromptPassphrase())...)
+}
+
 func getConfigDir(path string) (string, error) {
 	// TODO: validate
-	err := os.MkdirAll(path, os.ModePerm)
+	err := os.MkdirAll(path, 0700)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,41 @@
+package revssh
+
+import (
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestFileKeyManagerGeneratesOnce(t *testing.T) {
+	km := NewFileKeyManager(t.TempDir())
+	const conns = 8
+	results := make([][]ssh.Signer, conns)
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = km.GetPrivateKeys()
+		}(i)
+	}
+	wg.Wait()
+	for i, keys := range results {
+		if len(keys) != len(keynames) {
+			t.Fatalf("connection %d got %d host keys, want %d", i, len(keys), len(keynames))
+		}
+	}
+	// every connection ends up with the same keys, in the order they are
+	// loaded from now on.
+	want := map[string]bool{}
+	for _, key := range km.GetPrivateKeys() {
+		want[ssh.FingerprintSHA256(key.PublicKey())] = true
+	}
+	for i, keys := range results {
+		for _, key := range keys {
+			if !want[ssh.FingerprintSHA256(key.PublicKey())] {
+				t.Errorf("connection %d got a key that isn't on disk", i)
+			}
+		}
+	}
+}
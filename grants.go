@@ -0,0 +1,305 @@
+package revssh
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A Grant gives a user, group or key access to reverse clients for a limited
+// time.
+type Grant struct {
+	ID          string
+	Subject     string // a username, "@group" or a SHA256 key fingerprint.
+	Target      string // "host:<pattern>", "user:<name>" or a label selector.
+	Start       time.Time
+	End         time.Time
+	MaxSessions int // concurrent sessions allowed, 0 is unlimited.
+
+	rule     ACLRule
+	sessions int
+	revoked  chan struct{}
+}
+
+// A GrantStore is a ServerSettingsHandler that persists grants.
+type GrantStore interface {
+	LoadGrants() ([]*Grant, error)
+	SaveGrants(grants []*Grant) error
+}
+
+// NewGrant returns a grant for subject to the reverse clients matching target.
+func NewGrant(subject, target string, start, end time.Time, maxSessions int) (*Grant, error) {
+	if subject == "" || subject == "*" {
+		return nil, errors.New("grant needs a user, group or key")
+	}
+	if !end.After(start) {
+		return nil, errors.New("grant ends before it starts")
+	}
+	rule, err := parseACLRule(subject, []string{target})
+	if err != nil {
+		return nil, err
+	}
+	return &Grant{
+		Subject:     subject,
+		Target:      target,
+		Start:       start,
+		End:         end,
+		MaxSessions: maxSessions,
+		rule:        rule,
+		revoked:     make(chan struct{}),
+	}, nil
+}
+
+// ParseGrant parses a grant in the format written by String.
+func ParseGrant(line string) (*Grant, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("expected 6 fields in grant, got %d", len(fields))
+	}
+	start, err := time.Parse(time.RFC3339, fields[3])
+	if err != nil {
+		return nil, err
+	}
+	end, err := time.Parse(time.RFC3339, fields[4])
+	if err != nil {
+		return nil, err
+	}
+	max, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	g, err := NewGrant(fields[1], fields[2], start, end, max)
+	if err != nil {
+		return nil, err
+	}
+	g.ID = fields[0]
+	return g, nil
+}
+
+// String returns the grant as "id subject target start end max-sessions".
+func (g *Grant) String() string {
+	return fmt.Sprintf("%s %s %s %s %s %d", g.ID, g.Subject, g.Target,
+		g.Start.Format(time.RFC3339), g.End.Format(time.RFC3339), g.MaxSessions)
+}
+
+// Active reports whether the grant is in effect at t.
+func (g *Grant) Active(t time.Time) bool {
+	return !t.Before(g.Start) && t.Before(g.End)
+}
+
+// expire closes closers once the grant ends or is revoked, unless done is
+// closed first.
+func (g *Grant) expire(done <-chan struct{}, closers ...io.Closer) {
+	t := time.NewTimer(g.End.Sub(time.Now()))
+	defer t.Stop()
+	select {
+	case <-done:
+		return
+	case <-t.C:
+		log.Printf("GRANT: %s expired, closing session", g.ID)
+	case <-g.revoked:
+		log.Printf("GRANT: %s revoked, closing session", g.ID)
+	}
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+// grantList holds the grants of a server, loaded from its GrantStore on first
+// use.
+type grantList struct {
+	grants []*Grant
+	loaded bool
+	next   int
+	sync.Mutex
+}
+
+// load reads the grants from the GrantStore once. The caller holds the lock.
+func (gl *grantList) load(srv *Server) {
+	if gl.loaded {
+		return
+	}
+	gl.loaded = true
+	store, ok := srv.Settings.(GrantStore)
+	if !ok {
+		return
+	}
+	grants, err := store.LoadGrants()
+	if err != nil {
+		log.Printf("ERROR: loading grants: %+v", err)
+	}
+	gl.grants = grants
+	for _, g := range grants {
+		if n, err := strconv.Atoi(g.ID); err == nil && n > gl.next {
+			gl.next = n
+		}
+	}
+}
+
+// save writes the grants to the GrantStore. The caller holds the lock.
+func (gl *grantList) save(srv *Server) error {
+	if store, ok := srv.Settings.(GrantStore); ok {
+		return store.SaveGrants(gl.grants)
+	}
+	return nil
+}
+
+// useGrant returns an active grant allowing the user of sshConn to reach rc,
+// counting a session against it, or nil if there is none.
+func (srv *Server) useGrant(sshConn *ssh.ServerConn, rc *ReverseClientHandler) (*Grant, error) {
+	u := srv.user(sshConn)
+	fingerprint := connFingerprint(sshConn)
+	gl := &srv.grants
+	gl.Lock()
+	defer gl.Unlock()
+	gl.load(srv)
+	now := time.Now()
+	var err error
+	for _, g := range gl.grants {
+		if !g.Active(now) || !srv.isSubject(g.Subject, u, fingerprint) || !g.rule.matches(rc) {
+			continue
+		}
+		if g.MaxSessions > 0 && g.sessions >= g.MaxSessions {
+			err = fmt.Errorf("grant %s has no sessions left", g.ID)
+			continue
+		}
+		g.sessions++
+		return g, nil
+	}
+	return nil, err
+}
+
+// releaseGrant ends a session counted by useGrant.
+func (srv *Server) releaseGrant(g *Grant) {
+	srv.grants.Lock()
+	defer srv.grants.Unlock()
+	g.sessions--
+}
+
+// grantsCommand prints the grants and their sessions.
+func grantsCommand(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error {
+	gl := &srv.grants
+	gl.Lock()
+	defer gl.Unlock()
+	gl.load(srv)
+	now := time.Now()
+	for _, g := range gl.grants {
+		state := "active"
+		switch {
+		case now.Before(g.Start):
+			state = "pending"
+		case !g.Active(now):
+			state = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d sessions\n", g, state, g.sessions)
+	}
+	return nil
+}
+
+// grantCommand adds a grant, dropping expired ones:
+//
+//	grant [-start time] [-max-sessions n] subject target duration|end
+func grantCommand(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("grant", flag.ContinueOnError)
+	fs.SetOutput(w)
+	startArg := fs.String("start", "", "start time in RFC 3339 format, now if empty")
+	max := fs.Int("max-sessions", 0, "concurrent sessions allowed (0 is unlimited)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		return errors.New("usage: grant [-start time] [-max-sessions n] subject target duration|end")
+	}
+	start := time.Now().Truncate(time.Second)
+	if *startArg != "" {
+		var err error
+		if start, err = time.Parse(time.RFC3339, *startArg); err != nil {
+			return err
+		}
+	}
+	end, err := time.Parse(time.RFC3339, fs.Arg(2))
+	if err != nil {
+		d, derr := time.ParseDuration(fs.Arg(2))
+		if derr != nil {
+			return fmt.Errorf("invalid duration or end time %q", fs.Arg(2))
+		}
+		end = start.Add(d)
+	}
+	g, err := NewGrant(fs.Arg(0), fs.Arg(1), start, end, *max)
+	if err != nil {
+		return err
+	}
+
+	gl := &srv.grants
+	gl.Lock()
+	defer gl.Unlock()
+	gl.load(srv)
+	now := time.Now()
+	var grants []*Grant
+	for _, old := range gl.grants {
+		if now.Before(old.End) {
+			grants = append(grants, old)
+		}
+	}
+	oldGrants, oldNext := gl.grants, gl.next
+	gl.next++
+	g.ID = strconv.Itoa(gl.next)
+	gl.grants = append(grants, g)
+	if err := gl.save(srv); err != nil {
+		gl.grants, gl.next = oldGrants, oldNext
+		return fmt.Errorf("saving grants: %v", err)
+	}
+	log.Printf("GRANT: %s added by %s: %s", g.ID, sshConn.User(), g)
+	fmt.Fprintln(w, g)
+	return nil
+}
+
+// revokeCommand removes the grants with the given IDs, closing their
+// sessions. Nothing is revoked unless all the grants exist and the remaining
+// ones are saved.
+func revokeCommand(srv *Server, sshConn *ssh.ServerConn, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("missing grant ID")
+	}
+	gl := &srv.grants
+	gl.Lock()
+	defer gl.Unlock()
+	gl.load(srv)
+	revoke := make(map[string]bool)
+	for _, id := range args {
+		revoke[id] = true
+	}
+	var grants, revoked []*Grant
+	for _, g := range gl.grants {
+		if revoke[g.ID] {
+			revoked = append(revoked, g)
+			delete(revoke, g.ID)
+		} else {
+			grants = append(grants, g)
+		}
+	}
+	for _, id := range args {
+		if revoke[id] {
+			return fmt.Errorf("no grant %s", id)
+		}
+	}
+	oldGrants := gl.grants
+	gl.grants = grants
+	if err := gl.save(srv); err != nil {
+		gl.grants = oldGrants
+		return fmt.Errorf("saving grants: %v", err)
+	}
+	for _, g := range revoked {
+		close(g.revoked)
+		log.Printf("GRANT: %s revoked by %s", g.ID, sshConn.User())
+	}
+	return nil
+}
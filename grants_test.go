@@ -0,0 +1,62 @@
+package revssh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGrant(t *testing.T) {
+	tests := []struct {
+		line    string
+		wantErr bool
+	}{
+		{line: "1 alice host:db-* 2026-01-02T15:04:05Z 2026-01-02T16:04:05Z 0"},
+		{line: "2 @ops site=ams,role=db 2026-01-02T15:04:05+02:00 2026-01-03T15:04:05+02:00 3"},
+		{line: "3 SHA256:abc user:deploy 2026-01-02T15:04:05Z 2026-01-02T15:04:06Z 1"},
+		{line: "4 alice host:db 2026-01-02T15:04:05Z 2026-01-02T16:04:05Z", wantErr: true},
+		{line: "5 * host:db 2026-01-02T15:04:05Z 2026-01-02T16:04:05Z 0", wantErr: true},
+		{line: "6 alice host:db 2026-01-02T16:04:05Z 2026-01-02T15:04:05Z 0", wantErr: true},
+		{line: "7 alice host:db yesterday 2026-01-02T15:04:05Z 0", wantErr: true},
+		{line: "8 alice host:db 2026-01-02T15:04:05Z 2026-01-02T16:04:05Z many", wantErr: true},
+		{line: "9 alice host:[ 2026-01-02T15:04:05Z 2026-01-02T16:04:05Z 0", wantErr: true},
+	}
+	for _, tt := range tests {
+		g, err := ParseGrant(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseGrant(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := g.String(); got != tt.line {
+			t.Errorf("ParseGrant(%q).String() = %q", tt.line, got)
+		}
+		again, err := ParseGrant(g.String())
+		if err != nil || again.String() != g.String() {
+			t.Errorf("round trip of %q = %v, %v", tt.line, again, err)
+		}
+	}
+}
+
+func TestGrantActive(t *testing.T) {
+	start := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	g, err := NewGrant("alice", "host:db", start, start.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{start.Add(-time.Second), false},
+		{start, true},
+		{start.Add(time.Hour - time.Second), true},
+		{start.Add(time.Hour), false},
+	}
+	for _, tt := range tests {
+		if got := g.Active(tt.t); got != tt.want {
+			t.Errorf("Active(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package revssh
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cnf/revssh/revutil"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostCertsRequest asks the server to sign the host keys of a reverse client
+// into host certificates.
+const hostCertsRequest = "host-certificates@revssh"
+
+// signHostCerts signs the host keys of a reverse client with the host CA,
+// valid for its hostname and aliases in the virtual domain only, so the CA
+// can't vouch for hosts outside it.
+func (srv *Server) signHostCerts(rc *ReverseClientHandler) ([]*ssh.Certificate, error) {
+	if srv.HostCA == nil {
+		return nil, errors.New("no host CA")
+	}
+	if srv.virtualDomain() == "" {
+		return nil, errors.New("host certificates need a virtual domain")
+	}
+	var principals []string
+	for _, name := range rc.Names() {
+		principals = append(principals, srv.canonicalHostname(name))
+	}
+	now := time.Now()
+	var certs []*ssh.Certificate
+	for _, key := range rc.HostKeys {
+		var serial [8]byte
+		if _, err := rand.Read(serial[:]); err != nil {
+			return nil, err
+		}
+		cert := &ssh.Certificate{
+			Key:             key,
+			Serial:          binary.BigEndian.Uint64(serial[:]),
+			CertType:        ssh.HostCert,
+			KeyId:           "revssh:" + rc.Hostname,
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(now.Add(-5 * time.Minute).Unix()),
+			ValidBefore:     uint64(now.Add(srv.HostCertValidity).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, srv.HostCA); err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+func hostCertsRequestHandler(srv *Server, sshConn *ssh.ServerConn, req *ssh.Request) {
+	rc, err := srv.GetReverseClientBySession(sshConn.SessionID())
+	if err != nil {
+		req.Reply(false, []byte(err.Error()))
+		return
+	}
+	certs, err := srv.signHostCerts(rc)
+	if err != nil {
+		req.Reply(false, []byte(err.Error()))
+		return
+	}
+	var blobs [][]byte
+	for _, cert := range certs {
+		log.Printf("Signed host certificate for %s: %s", rc.Hostname, ssh.FingerprintSHA256(cert.Key))
+		blobs = append(blobs, cert.Marshal())
+	}
+	req.Reply(true, marshalBlobs(blobs))
+}
+
+// hostCertSettings adds host certificates, signed by the server, to the host
+// keys of the embedded sshd.
+type hostCertSettings struct {
+	ClientSettingsHandler
+	certs []ssh.Signer
+	sync.Mutex
+}
+
+// GetPrivateKeys returns the host certificates, followed by the host keys.
+func (s *hostCertSettings) GetPrivateKeys() []ssh.Signer {
+	s.Lock()
+	certs := append([]ssh.Signer(nil), s.certs...)
+	s.Unlock()
+	return append(certs, s.ClientSettingsHandler.GetPrivateKeys()...)
+}
+
+// refresh fetches host certificates from the server, and returns when they
+// should be fetched again, or 0 if the server doesn't sign host keys.
+func (s *hostCertSettings) refresh(conn *ssh.Client) time.Duration {
+	ok, reply, err := conn.SendRequest(hostCertsRequest, true, nil)
+	if err != nil || !ok {
+		return 0
+	}
+	blobs, err := parseBlobs(reply)
+	if err != nil {
+		log.Printf("invalid host certificates: %s", err)
+		return 0
+	}
+	signers := s.ClientSettingsHandler.GetPrivateKeys()
+	var certs []ssh.Signer
+	var expires time.Time
+	for _, blob := range blobs {
+		key, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			continue
+		}
+		cert, ok := key.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.HostCert {
+			continue
+		}
+		for _, signer := range signers {
+			if !revutil.KeysEqual(signer.PublicKey(), cert.Key) {
+				continue
+			}
+			certSigner, err := ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				log.Printf("%+v", err)
+				break
+			}
+			certs = append(certs, certSigner)
+			until := time.Unix(int64(cert.ValidBefore), 0)
+			if expires.IsZero() || until.Before(expires) {
+				expires = until
+			}
+			break
+		}
+	}
+	if len(certs) == 0 {
+		return 0
+	}
+	log.Printf("Received %d host certificates, valid until %s", len(certs), expires)
+	s.Lock()
+	s.certs = certs
+	s.Unlock()
+	if d := time.Until(expires) / 2; d > time.Minute {
+		return d
+	}
+	return time.Minute
+}
+
+// refreshHostCerts fetches the host certificates again after d, and keeps
+// them fresh until done is closed.
+func (s *hostCertSettings) refreshHostCerts(conn *ssh.Client, d time.Duration, done <-chan struct{}) {
+	for d > 0 {
+		select {
+		case <-done:
+			return
+		case <-time.After(d):
+			d = s.refresh(conn)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package revssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyChecking controls how unknown and changed host keys are handled, like
+// StrictHostKeyChecking does for OpenSSH.
+type HostKeyChecking int
+
+// Host key checking modes.
+const (
+	AcceptNew  HostKeyChecking = iota // add unknown keys, reject changed keys.
+	Strict                            // reject unknown and changed keys.
+	Ask                               // ask on the terminal about unknown keys, reject changed keys.
+	NoChecking                        // add unknown keys, accept changed keys.
+)
+
+// ParseHostKeyChecking parses a host key checking mode, as accepted by
+// OpenSSH's StrictHostKeyChecking option.
+func ParseHostKeyChecking(mode string) (HostKeyChecking, error) {
+	switch strings.ToLower(mode) {
+	case "accept-new", "":
+		return AcceptNew, nil
+	case "strict", "yes":
+		return Strict, nil
+	case "ask":
+		return Ask, nil
+	case "off", "no":
+		return NoChecking, nil
+	}
+	return AcceptNew, fmt.Errorf("unknown host key checking mode: %s", mode)
+}
+
+func (m HostKeyChecking) String() string {
+	switch m {
+	case AcceptNew:
+		return "accept-new"
+	case Strict:
+		return "strict"
+	case Ask:
+		return "ask"
+	case NoChecking:
+		return "off"
+	}
+	return fmt.Sprintf("HostKeyChecking(%d)", int(m))
+}
+
+// A HostKeyError is returned when a host key is rejected.
+type HostKeyError struct {
+	Hostname    string // host that presented the key.
+	Fingerprint string // SHA256 fingerprint of the rejected key.
+	Reason      string // why the key was rejected.
+	Unknown     bool   // the host has no known keys, rather than other ones.
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("host key %s for %s %s", e.Fingerprint, e.Hostname, e.Reason)
+}
+
+// unknownHost reports whether err rejects a host key only because the host
+// has no known keys.
+func unknownHost(err error) bool {
+	var hkErr *HostKeyError
+	var keyErr *knownhosts.KeyError
+	switch {
+	case errors.As(err, &hkErr):
+		return hkErr.Unknown
+	case errors.As(err, &keyErr):
+		return len(keyErr.Want) == 0
+	}
+	return false
+}
+
+// askHostKey asks on the terminal whether an unknown host key can be trusted.
+func askHostKey(hostname, fingerprint string) bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "The authenticity of host '%s' can't be established.\nKey fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ", hostname, fingerprint)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(strings.ToLower(answer)) == "yes"
+}
@@ -0,0 +1,242 @@
+package revssh
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+
+	"github.com/cnf/revssh/revutil"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// OpenSSH host key rotation, see PROTOCOL in the OpenSSH sources, section 2.5.
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// hostKeys returns the active and retiring host keys of this server.
+func (srv *Server) hostKeys() (active, retiring []ssh.Signer) {
+	for _, signer := range srv.Settings.GetPrivateKeys() {
+		if signer != nil {
+			active = append(active, signer)
+		}
+	}
+	if rotator, ok := srv.Settings.(HostKeyRotator); ok {
+		for _, signer := range rotator.GetRetiringKeys() {
+			if signer != nil {
+				retiring = append(retiring, signer)
+			}
+		}
+	}
+	return active, retiring
+}
+
+// announceHostKeys sends all active and retiring host keys to the client, so
+// it can learn new keys and forget removed ones.
+func (srv *Server) announceHostKeys(sshConn ssh.Conn) {
+	active, retiring := srv.hostKeys()
+	var blobs [][]byte
+	for _, signer := range append(active, retiring...) {
+		blobs = append(blobs, signer.PublicKey().Marshal())
+	}
+	if len(blobs) == 0 {
+		return
+	}
+	if _, _, err := sshConn.SendRequest(hostKeysRequest, false, marshalBlobs(blobs)); err != nil {
+		log.Printf("could not announce host keys: %s", err)
+	}
+}
+
+// hostkeysProveRequestHandler signs each requested host key, together with the
+// session ID, proving this server holds the private keys.
+func hostkeysProveRequestHandler(srv *Server, sshConn *ssh.ServerConn, req *ssh.Request) {
+	blobs, err := parseBlobs(req.Payload)
+	if err != nil {
+		log.Printf("%+v", err)
+		req.Reply(false, nil)
+		return
+	}
+	active, retiring := srv.hostKeys()
+	signers := append(active, retiring...)
+	var sigs [][]byte
+	for _, blob := range blobs {
+		key, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		var signer ssh.Signer
+		for i := range signers {
+			if revutil.KeysEqual(signers[i].PublicKey(), key) {
+				signer = signers[i]
+				break
+			}
+		}
+		if signer == nil {
+			log.Printf("host key proof requested for unknown key %s", ssh.FingerprintSHA256(key))
+			req.Reply(false, nil)
+			return
+		}
+		sig, err := signHostKeyProof(signer, sshConn.SessionID(), blob)
+		if err != nil {
+			log.Printf("%+v", err)
+			req.Reply(false, nil)
+			return
+		}
+		sigs = append(sigs, ssh.Marshal(sig))
+	}
+	req.Reply(true, marshalBlobs(sigs))
+}
+
+func hostKeyProofData(sessionID, blob []byte) []byte {
+	return ssh.Marshal(struct {
+		Prefix    string
+		SessionID []byte
+		Key       []byte
+	}{hostKeysProveRequest, sessionID, blob})
+}
+
+func signHostKeyProof(signer ssh.Signer, sessionID, blob []byte) (*ssh.Signature, error) {
+	data := hostKeyProofData(sessionID, blob)
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return as.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+// updateHostKeys handles a host key announcement from the server. Keys we do
+// not know yet are only accepted once the server proves it holds them. The
+// known hosts entry for the server is then replaced by the announced keys,
+// always keeping the key this connection was verified with.
+func (rc *ReverseClient) updateHostKeys(conn *ssh.Client, payload []byte) {
+	updater, ok := rc.Settings.(KnownHostsUpdater)
+	if !ok {
+		return
+	}
+	blobs, err := parseBlobs(payload)
+	if err != nil {
+		log.Printf("invalid host key announcement: %s", err)
+		return
+	}
+	hostname := knownhosts.Normalize(rc.Settings.Remote())
+	known, err := updater.KnownHostKeys(hostname)
+	if err != nil {
+		log.Printf("ERROR: %+v", err)
+		return
+	}
+	var announced []ssh.PublicKey
+	var unknown [][]byte
+	for _, blob := range blobs {
+		key, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			// OpenSSH skips key types it does not support.
+			continue
+		}
+		announced = append(announced, key)
+		if !containsKey(known, key) {
+			unknown = append(unknown, blob)
+		}
+	}
+	if len(unknown) > 0 {
+		if err := proveHostKeys(conn, unknown); err != nil {
+			log.Printf("host key rotation for %s failed: %s", hostname, err)
+			return
+		}
+	}
+	current := rc.currentHostKey()
+	if current != nil && !containsKey(announced, current) {
+		announced = append(announced, current)
+	}
+	changed := len(unknown) > 0
+	for _, key := range known {
+		if !containsKey(announced, key) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	for _, key := range announced {
+		if !containsKey(known, key) {
+			log.Printf("Learned host key %s for %s", ssh.FingerprintSHA256(key), hostname)
+		}
+	}
+	for _, key := range known {
+		if !containsKey(announced, key) {
+			log.Printf("Forgetting host key %s for %s", ssh.FingerprintSHA256(key), hostname)
+		}
+	}
+	if err := updater.UpdateKnownHost(hostname, announced); err != nil {
+		log.Printf("ERROR: %+v", err)
+	}
+}
+
+// proveHostKeys asks the server to prove it holds the private keys for blobs.
+func proveHostKeys(conn *ssh.Client, blobs [][]byte) error {
+	ok, reply, err := conn.SendRequest(hostKeysProveRequest, true, marshalBlobs(blobs))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("server refused to prove host keys")
+	}
+	sigs, err := parseBlobs(reply)
+	if err != nil {
+		return err
+	}
+	if len(sigs) != len(blobs) {
+		return errors.New("host key proof count mismatch")
+	}
+	for i := range blobs {
+		key, err := ssh.ParsePublicKey(blobs[i])
+		if err != nil {
+			return err
+		}
+		sig := &ssh.Signature{}
+		if err := ssh.Unmarshal(sigs[i], sig); err != nil {
+			return err
+		}
+		if err := key.Verify(hostKeyProofData(conn.SessionID(), blobs[i]), sig); err != nil {
+			return errors.New("invalid proof for host key " + ssh.FingerprintSHA256(key))
+		}
+	}
+	return nil
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for i := range keys {
+		if revutil.KeysEqual(keys[i], key) {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalBlobs encodes a list of blobs as consecutive ssh strings.
+func marshalBlobs(blobs [][]byte) []byte {
+	var out []byte
+	for _, blob := range blobs {
+		out = append(out, ssh.Marshal(struct{ Blob []byte }{blob})...)
+	}
+	return out
+}
+
+// parseBlobs decodes consecutive ssh strings.
+func parseBlobs(data []byte) ([][]byte, error) {
+	var blobs [][]byte
+	for len(data) > 0 {
+		var s struct {
+			Blob []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, s.Blob)
+		data = s.Rest
+	}
+	return blobs, nil
+}
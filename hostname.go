@@ -0,0 +1,106 @@
+package revssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// DefaultReservedHostnames are names a reverse client can never register.
+var DefaultReservedHostnames = []string{"localhost", "localhost.localdomain", "ip6-localhost", "ip6-loopback", "broadcasthost"}
+
+// NormalizeHostname validates a hostname as per RFC 1123, after converting
+// internationalized names to their ASCII form, lowercasing them, and stripping
+// the virtual domain, if any.
+func NormalizeHostname(name, domain string) (string, error) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "", errors.New("empty hostname")
+	}
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid hostname %q: %s", name, err)
+	}
+	name = strings.ToLower(ascii)
+	if domain = strings.Trim(strings.ToLower(domain), "."); domain != "" {
+		if name == domain {
+			return "", fmt.Errorf("invalid hostname %q: is the virtual domain", name)
+		}
+		name = strings.TrimSuffix(name, "."+domain)
+	}
+	if len(name) > 253 {
+		return "", fmt.Errorf("invalid hostname %q: too long", name)
+	}
+	if net.ParseIP(name) != nil {
+		return "", fmt.Errorf("invalid hostname %q: is an IP address", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if err := checkLabel(label); err != nil {
+			return "", fmt.Errorf("invalid hostname %q: %s", name, err)
+		}
+	}
+	return name, nil
+}
+
+// checkLabel validates one label of a hostname, as per RFC 1123 Section 2.1.
+func checkLabel(label string) error {
+	if label == "" {
+		return errors.New("empty label")
+	}
+	if len(label) > 63 {
+		return fmt.Errorf("label %q too long", label)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label %q starts or ends with a hyphen", label)
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("label %q contains %q", label, c)
+		}
+	}
+	return nil
+}
+
+// normalizeHostname normalizes a hostname with the virtual domain of the
+// server, and rejects reserved names.
+func (srv *Server) normalizeHostname(name string) (string, error) {
+	normalized, err := NormalizeHostname(name, srv.VirtualDomain)
+	if err != nil {
+		return "", err
+	}
+	for _, reserved := range srv.ReservedHostnames {
+		if normalized == strings.ToLower(reserved) {
+			return "", fmt.Errorf("hostname %s is reserved", normalized)
+		}
+	}
+	return normalized, nil
+}
+
+// virtualDomain returns the virtual domain of the server, lower cased and
+// without dots around it, or "" if there is none.
+func (srv *Server) virtualDomain() string {
+	return strings.Trim(strings.ToLower(srv.VirtualDomain), ".")
+}
+
+// canonicalHostname returns a normalized name in the virtual domain, if any.
+func (srv *Server) canonicalHostname(name string) string {
+	if domain := srv.virtualDomain(); domain != "" {
+		return name + "." + domain
+	}
+	return name
+}
+
+// qualifiedNames returns the names of a reverse client, followed by those
+// names in the virtual domain, if any.
+func (srv *Server) qualifiedNames(rc *ReverseClientHandler) []string {
+	names := rc.Names()
+	for _, name := range rc.Names() {
+		if canonical := srv.canonicalHostname(name); canonical != name {
+			names = append(names, canonical)
+		}
+	}
+	return names
+}
@@ -0,0 +1,45 @@
+package revssh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		name, domain string
+		want         string
+		wantErr      bool
+	}{
+		{name: "web1", want: "web1"},
+		{name: " Web1.Example.COM. ", want: "web1.example.com"},
+		{name: "web1.rev.test", domain: "rev.test", want: "web1"},
+		{name: "web1.rev.test", domain: ".Rev.Test.", want: "web1"},
+		{name: "web1.other.test", domain: "rev.test", want: "web1.other.test"},
+		{name: "bücher", want: "xn--bcher-kva"},
+		{name: "a-b.c-d", want: "a-b.c-d"},
+		{name: "", wantErr: true},
+		{name: ".", wantErr: true},
+		{name: "rev.test", domain: "rev.test", wantErr: true},
+		{name: "10.0.0.1", wantErr: true},
+		{name: "::1", wantErr: true},
+		{name: "-web", wantErr: true},
+		{name: "web-", wantErr: true},
+		{name: "web..example", wantErr: true},
+		{name: "web_1", wantErr: true},
+		{name: "web 1", wantErr: true},
+		{name: strings.Repeat("a", 64), wantErr: true},
+		{name: strings.Repeat("a", 63), want: strings.Repeat("a", 63)},
+		{name: strings.Repeat("a.", 127) + "aa", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeHostname(tt.name, tt.domain)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NormalizeHostname(%q, %q) error = %v, wantErr %v", tt.name, tt.domain, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("NormalizeHostname(%q, %q) = %q, want %q", tt.name, tt.domain, got, tt.want)
+		}
+	}
+}
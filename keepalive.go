@@ -0,0 +1,55 @@
+package revssh
+
+import (
+	"log"
+	"time"
+)
+
+// probeReverseClient sends keepalives to a registered reverse client, keeping
+// track of when it was last seen and its round trip time. Once it misses
+// ReverseKeepAliveMax keepalives in a row, it is evicted and disconnected.
+func (srv *Server) probeReverseClient(rc *ReverseClientHandler) {
+	closed := make(chan struct{})
+	go func() {
+		rc.SSHConn.Wait()
+		close(closed)
+	}()
+	ticker := time.NewTicker(srv.ReverseKeepAliveInterval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		replies := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			// any reply, even a failure, proves the client is alive.
+			_, _, err := rc.SSHConn.SendRequest("keepalive@openssh.com", true, nil)
+			replies <- err
+		}()
+		select {
+		case <-closed:
+			return
+		case err := <-replies:
+			if err == nil {
+				rc.Seen(time.Since(start))
+				missed = 0
+				continue
+			}
+			log.Printf("Keepalive to %s failed: %s", rc.Hostname, err)
+		case <-time.After(srv.ReverseKeepAliveInterval):
+			log.Printf("Keepalive to %s timed out", rc.Hostname)
+		}
+		missed++
+		if missed >= srv.ReverseKeepAliveMax {
+			lastSeen, _ := rc.LastSeen()
+			log.Printf("Evicting reverse client %s, last seen %s ago", rc.Hostname, time.Since(lastSeen))
+			srv.RemoveReverseClient(rc.SSHConn.SessionID())
+			rc.SSHConn.Close()
+			return
+		}
+	}
+}
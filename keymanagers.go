@@ -1,8 +1,11 @@
 package revssh
 
 import (
+	"errors"
 	"net"
 
+	"github.com/cnf/revssh/revutil"
+
 	"golang.org/x/crypto/ssh"
 )
 
@@ -35,9 +38,361 @@ type KeyManager interface {
 	GetPrivateKeys() []ssh.Signer
 }
 
+// A UserKeyManager is a KeyManager that can have keys set up per user. Once
+// it does, the keys returned by GetAuthorizedKeys no longer log in as every
+// user, only the keys GetPublicKeys returns for a user log in as that user.
+type UserKeyManager interface {
+	// HasUserKeys reports whether keys are set up per user.
+	HasUserKeys() bool
+}
+
+// A HostKeyRotator is a KeyManager that also holds host keys being rotated
+// out. Retiring keys keep being served in handshakes, in favour of active keys
+// of the same type, and are announced next to the active keys, so clients learn
+// the new keys before the old ones go away.
+type HostKeyRotator interface {
+	// GetRetiringKeys returns a list of signers that are being rotated out.
+	GetRetiringKeys() []ssh.Signer
+}
+
+// A KnownHostsUpdater is a KeyManager that can replace the known keys of a
+// host, as announced by that host after proving it holds them.
+type KnownHostsUpdater interface {
+	// KnownHostKeys returns the public keys known for hostname.
+	KnownHostKeys(hostname string) ([]ssh.PublicKey, error)
+	// UpdateKnownHost replaces the public keys known for hostname.
+	UpdateKnownHost(hostname string, keys []ssh.PublicKey) error
+}
+
+// An IdentityKeyManager is a KeyManager that holds the keys a client
+// authenticates with, apart from the host keys returned by GetPrivateKeys.
+type IdentityKeyManager interface {
+	// GetIdentityKeys returns a list of signers to authenticate with.
+	// If no identity keys are available, one should be created.
+	GetIdentityKeys() []ssh.Signer
+}
+
+// ErrNoIdentityKeys is returned when a client has no keys to authenticate
+// with, which no amount of reconnecting fixes.
+var ErrNoIdentityKeys = errors.New("identity key not found")
+
+// identityKeys returns the identity keys of km, or its private keys if it
+// doesn't keep identity keys apart.
+func identityKeys(km KeyManager) []ssh.Signer {
+	if ikm, ok := km.(IdentityKeyManager); ok {
+		return ikm.GetIdentityKeys()
+	}
+	return km.GetPrivateKeys()
+}
+
 // // A PrivateKeyManager handles private keys.
 // type PrivateKeyManager interface {
 // 	// GetPrivateKeys returns a list of signers.
 // 	// If no private keys are available, one should be created.
 // 	GetPrivateKeys() []ssh.Signer
 // }
+
+// A ChainKeyManager asks its KeyManagers in order, and uses the first answer.
+// Key lists come from the first KeyManager returning any keys, and a host is
+// known as soon as one KeyManager accepts it. As KeyManagers may generate
+// private keys or add unknown hosts, the ones that do should go last.
+type ChainKeyManager []KeyManager
+
+// GetPublicKeys returns the publickeys for username from the first KeyManager
+// that has any.
+func (c ChainKeyManager) GetPublicKeys(username string) ([]ssh.PublicKey, error) {
+	var lastErr error
+	for _, km := range c {
+		keys, err := km.GetPublicKeys(username)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(keys) > 0 {
+			return keys, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// GetAuthorizedKeys returns the authorized keys of the first KeyManager that
+// has any.
+func (c ChainKeyManager) GetAuthorizedKeys() []ssh.PublicKey {
+	for _, km := range c {
+		if keys := km.GetAuthorizedKeys(); len(keys) > 0 {
+			return keys
+		}
+	}
+	return nil
+}
+
+// IsKnownHost accepts the host key as soon as one KeyManager accepts it. Only
+// KeyManagers that don't know the host pass it on to the next one, any other
+// rejection, such as a changed key, is returned as is.
+func (c ChainKeyManager) IsKnownHost(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	var firstErr error
+	for _, km := range c {
+		err := km.IsKnownHost(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		if !unknownHost(err) {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		return errors.New("no key managers")
+	}
+	return firstErr
+}
+
+// ListAuthorizedKeys returns the authorized keys, with their options, of the
+// first KeyManager that has any.
+func (c ChainKeyManager) ListAuthorizedKeys() ([]*AuthorizedKey, error) {
+	var lastErr error
+	for _, km := range c {
+		keys, err := listAuthorizedKeys(km)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(keys) > 0 {
+			return keys, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// GetPrivateKeys returns the private keys of the first KeyManager that has
+// any.
+func (c ChainKeyManager) GetPrivateKeys() []ssh.Signer {
+	for _, km := range c {
+		if keys := km.GetPrivateKeys(); len(keys) > 0 {
+			return keys
+		}
+	}
+	return nil
+}
+
+// GetRetiringKeys returns the retiring keys of the first KeyManager that has
+// any.
+func (c ChainKeyManager) GetRetiringKeys() []ssh.Signer {
+	for _, km := range c {
+		if rotator, ok := km.(HostKeyRotator); ok {
+			if keys := rotator.GetRetiringKeys(); len(keys) > 0 {
+				return keys
+			}
+		}
+	}
+	return nil
+}
+
+// HasUserKeys reports whether any KeyManager has keys set up per user.
+func (c ChainKeyManager) HasUserKeys() bool {
+	return hasUserKeys(c)
+}
+
+// GetIdentityKeys returns the identity keys of the first KeyManager that has
+// any.
+func (c ChainKeyManager) GetIdentityKeys() []ssh.Signer {
+	for _, km := range c {
+		if keys := identityKeys(km); len(keys) > 0 {
+			return keys
+		}
+	}
+	return nil
+}
+
+// KnownHostKeys returns the known keys from the first KeyManager that can
+// update known hosts.
+func (c ChainKeyManager) KnownHostKeys(hostname string) ([]ssh.PublicKey, error) {
+	return knownHostsUpdater(c).KnownHostKeys(hostname)
+}
+
+// UpdateKnownHost updates the first KeyManager that can update known hosts.
+func (c ChainKeyManager) UpdateKnownHost(hostname string, keys []ssh.PublicKey) error {
+	return knownHostsUpdater(c).UpdateKnownHost(hostname, keys)
+}
+
+// A MergeKeyManager combines the keys of all its KeyManagers. Where keys
+// collide, as with private keys of the same type, earlier KeyManagers take
+// precedence. A host is only known if all KeyManagers accept it.
+type MergeKeyManager []KeyManager
+
+// GetPublicKeys returns the publickeys for username from all KeyManagers. An
+// error is only returned if all KeyManagers fail.
+func (m MergeKeyManager) GetPublicKeys(username string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	var lastErr error
+	failed := 0
+	for _, km := range m {
+		k, err := km.GetPublicKeys(username)
+		if err != nil {
+			lastErr = err
+			failed++
+			continue
+		}
+		keys = appendUniqueKeys(keys, k...)
+	}
+	if failed > 0 && failed == len(m) {
+		return nil, lastErr
+	}
+	return keys, nil
+}
+
+// GetAuthorizedKeys returns the authorized keys of all KeyManagers.
+func (m MergeKeyManager) GetAuthorizedKeys() []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	for _, km := range m {
+		keys = appendUniqueKeys(keys, km.GetAuthorizedKeys()...)
+	}
+	return keys
+}
+
+// ListAuthorizedKeys returns the authorized keys, with their options, of all
+// KeyManagers. An error is only returned if all KeyManagers fail.
+func (m MergeKeyManager) ListAuthorizedKeys() ([]*AuthorizedKey, error) {
+	var keys []*AuthorizedKey
+	var lastErr error
+	failed := 0
+	seen := make(map[string]bool)
+	for _, km := range m {
+		list, err := listAuthorizedKeys(km)
+		if err != nil {
+			lastErr = err
+			failed++
+			continue
+		}
+		for _, ak := range list {
+			id := ak.Username + " " + ak.String()
+			if !seen[id] {
+				seen[id] = true
+				keys = append(keys, ak)
+			}
+		}
+	}
+	if failed > 0 && failed == len(m) {
+		return nil, lastErr
+	}
+	return keys, nil
+}
+
+// IsKnownHost only accepts the host key if all KeyManagers accept it.
+func (m MergeKeyManager) IsKnownHost(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	for _, km := range m {
+		if err := km.IsKnownHost(hostname, remote, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPrivateKeys returns the private keys of all KeyManagers, one per key
+// type.
+func (m MergeKeyManager) GetPrivateKeys() []ssh.Signer {
+	var keys []ssh.Signer
+	for _, km := range m {
+		keys = appendUniqueSigners(keys, km.GetPrivateKeys()...)
+	}
+	return keys
+}
+
+// GetRetiringKeys returns the retiring keys of all KeyManagers.
+func (m MergeKeyManager) GetRetiringKeys() []ssh.Signer {
+	var keys []ssh.Signer
+	for _, km := range m {
+		if rotator, ok := km.(HostKeyRotator); ok {
+			keys = appendUniqueSigners(keys, rotator.GetRetiringKeys()...)
+		}
+	}
+	return keys
+}
+
+// HasUserKeys reports whether any KeyManager has keys set up per user.
+func (m MergeKeyManager) HasUserKeys() bool {
+	return hasUserKeys(m)
+}
+
+// GetIdentityKeys returns the identity keys of all KeyManagers, one per key
+// type.
+func (m MergeKeyManager) GetIdentityKeys() []ssh.Signer {
+	var keys []ssh.Signer
+	for _, km := range m {
+		keys = appendUniqueSigners(keys, identityKeys(km)...)
+	}
+	return keys
+}
+
+// KnownHostKeys returns the known keys from the first KeyManager that can
+// update known hosts.
+func (m MergeKeyManager) KnownHostKeys(hostname string) ([]ssh.PublicKey, error) {
+	return knownHostsUpdater(m).KnownHostKeys(hostname)
+}
+
+// UpdateKnownHost updates the first KeyManager that can update known hosts.
+func (m MergeKeyManager) UpdateKnownHost(hostname string, keys []ssh.PublicKey) error {
+	return knownHostsUpdater(m).UpdateKnownHost(hostname, keys)
+}
+
+// noKnownHostsUpdater is used when none of the KeyManagers can update known
+// hosts.
+type noKnownHostsUpdater struct{}
+
+func (noKnownHostsUpdater) KnownHostKeys(hostname string) ([]ssh.PublicKey, error) {
+	return nil, errors.New("key manager can't update known hosts")
+}
+
+func (noKnownHostsUpdater) UpdateKnownHost(hostname string, keys []ssh.PublicKey) error {
+	return errors.New("key manager can't update known hosts")
+}
+
+func knownHostsUpdater(kms []KeyManager) KnownHostsUpdater {
+	for _, km := range kms {
+		if updater, ok := km.(KnownHostsUpdater); ok {
+			return updater
+		}
+	}
+	return noKnownHostsUpdater{}
+}
+
+func hasUserKeys(kms []KeyManager) bool {
+	for _, km := range kms {
+		if ukm, ok := km.(UserKeyManager); ok && ukm.HasUserKeys() {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUniqueKeys appends the keys not yet in list.
+func appendUniqueKeys(list []ssh.PublicKey, keys ...ssh.PublicKey) []ssh.PublicKey {
+	for _, key := range keys {
+		if key != nil && !containsKey(list, key) {
+			list = append(list, key)
+		}
+	}
+	return list
+}
+
+// appendUniqueSigners appends the signers of a key type not yet in list.
+func appendUniqueSigners(list []ssh.Signer, signers ...ssh.Signer) []ssh.Signer {
+	for _, signer := range signers {
+		if signer == nil {
+			continue
+		}
+		found := false
+		for i := range list {
+			if list[i].PublicKey().Type() == signer.PublicKey().Type() || revutil.KeysEqual(list[i].PublicKey(), signer.PublicKey()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, signer)
+		}
+	}
+	return list
+}
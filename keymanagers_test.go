@@ -0,0 +1,151 @@
+package revssh
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testConnMetadata is the ssh.ConnMetadata of a connection authenticating as
+// user.
+type testConnMetadata struct {
+	user string
+}
+
+func (c testConnMetadata) User() string          { return c.user }
+func (c testConnMetadata) SessionID() []byte     { return []byte(c.user) }
+func (c testConnMetadata) ClientVersion() []byte { return []byte("SSH-2.0-test") }
+func (c testConnMetadata) ServerVersion() []byte { return []byte("SSH-2.0-test") }
+func (c testConnMetadata) RemoteAddr() net.Addr  { return testAddr("192.0.2.1:1234") }
+func (c testConnMetadata) LocalAddr() net.Addr   { return testAddr("192.0.2.2:22") }
+
+// writeAuthorizedKey writes key to the authorized keys file at path.
+func writeAuthorizedKey(t *testing.T, path string, key ssh.PublicKey) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCombinedKeyManagersHaveUserKeys(t *testing.T) {
+	dir := t.TempDir()
+	global, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAuthorizedKey(t, filepath.Join(dir, "authorized_keys"), global.PublicKey())
+	writeAuthorizedKey(t, filepath.Join(dir, "authorized_keys.d", "alice"), alice.PublicKey())
+	fkm := NewFileKeyManager(dir)
+	plain := NewFileKeyManager(t.TempDir())
+
+	tests := []struct {
+		name string
+		km   KeyManager
+		want bool
+	}{
+		{"file", fkm, true},
+		{"chain", ChainKeyManager{NewMemoryKeyManager(), fkm}, true},
+		{"merge", MergeKeyManager{fkm, NewMemoryKeyManager()}, true},
+		{"nested", ChainKeyManager{MergeKeyManager{plain, fkm}}, true},
+		{"without authorized_keys.d", ChainKeyManager{plain, NewMemoryKeyManager()}, false},
+	}
+	for _, tt := range tests {
+		ukm, ok := tt.km.(UserKeyManager)
+		if !ok {
+			t.Errorf("%s: not a UserKeyManager", tt.name)
+			continue
+		}
+		if got := ukm.HasUserKeys(); got != tt.want {
+			t.Errorf("%s: HasUserKeys = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// the global authorized_keys don't log in as every user behind a chain.
+	srv := NewServer()
+	srv.Settings = ChainKeyManager{fkm}
+	logins := []struct {
+		user string
+		key  ssh.PublicKey
+		want bool
+	}{
+		{"alice", alice.PublicKey(), true},
+		{"alice", global.PublicKey(), false},
+		{"bob", global.PublicKey(), false},
+	}
+	for _, l := range logins {
+		_, err := srv.publicKeyCallback(testConnMetadata{l.user}, l.key)
+		if (err == nil) != l.want {
+			t.Errorf("login as %s with %s: error = %v, want success %v", l.user, ssh.FingerprintSHA256(l.key), err, l.want)
+		}
+	}
+}
+
+// plainKeyManager hides every method of its KeyManager outside the interface.
+type plainKeyManager struct {
+	KeyManager
+}
+
+func TestCombinedKeyManagersListAuthorizedKeys(t *testing.T) {
+	plainKey, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restricted, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	lines := string(ssh.MarshalAuthorizedKey(plainKey.PublicKey())) +
+		`restrict,permitopen="db:5432" ` + string(ssh.MarshalAuthorizedKey(restricted.PublicKey()))
+	if err := ioutil.WriteFile(filepath.Join(dir, "authorized_keys"), []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fkm := NewFileKeyManager(dir)
+	mkm := NewMemoryKeyManager()
+	mkm.AddAuthorizedKey(extra.PublicKey())
+	full := []string{
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(plainKey.PublicKey()))),
+		`restrict,permitopen="db:5432" ` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(restricted.PublicKey()))),
+	}
+
+	tests := []struct {
+		name string
+		km   KeyManager
+		want []string
+	}{
+		{"chain", ChainKeyManager{NewMemoryKeyManager(), fkm, mkm}, full},
+		{"merge", MergeKeyManager{fkm, fkm, mkm}, append(full, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(extra.PublicKey()))))},
+		// without ListAuthorizedKeys, the key with options is left out instead
+		// of being sent without them.
+		{"fallback", ChainKeyManager{plainKeyManager{fkm}}, full[:1]},
+	}
+	for _, tt := range tests {
+		keys, err := listAuthorizedKeys(tt.km)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, ak := range keys {
+			got = append(got, ak.String())
+		}
+		if !equalStrings(got, tt.want) {
+			t.Errorf("%s: ListAuthorizedKeys = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package revssh
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A knownHostsDB holds the entries of a known_hosts file, and checks host
+// keys against them the way the knownhosts package does, without needing the
+// entries in a file.
+type knownHostsDB struct {
+	lines   []knownHostsLine
+	revoked map[string]knownhosts.KnownKey // marshaled revoked keys.
+}
+
+type knownHostsLine struct {
+	cert     bool // a @cert-authority line.
+	patterns []hostPattern
+	key      knownhosts.KnownKey
+}
+
+// A hostPattern matches a host and port, either by a pattern with * and ?
+// wildcards or by a hash of the host.
+type hostPattern struct {
+	negate     bool
+	host, port string
+	salt, hash []byte // set for hashed hosts.
+}
+
+// parseKnownHostsDB parses known_hosts data, skipping and reporting bad lines.
+func parseKnownHostsDB(path string, data []byte) *knownHostsDB {
+	db := &knownHostsDB{revoked: make(map[string]knownhosts.KnownKey)}
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err == nil && marker != "" && marker != "cert-authority" && marker != "revoked" {
+			err = fmt.Errorf("unknown marker @%s", marker)
+		}
+		if err != nil {
+			log.Printf("ERROR: %s:%d: %+v, skipping", path, i+1, err)
+			continue
+		}
+		known := knownhosts.KnownKey{Key: key, Filename: path, Line: i + 1}
+		if marker == "revoked" {
+			db.revoked[string(key.Marshal())] = known
+			continue
+		}
+		patterns, err := parseHostPatterns(hosts)
+		if err != nil {
+			log.Printf("ERROR: %s:%d: %+v, skipping", path, i+1, err)
+			continue
+		}
+		db.lines = append(db.lines, knownHostsLine{cert: marker == "cert-authority", patterns: patterns, key: known})
+	}
+	return db
+}
+
+func parseHostPatterns(hosts []string) ([]hostPattern, error) {
+	var patterns []hostPattern
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		var p hostPattern
+		if host[0] == '!' {
+			p.negate = true
+			host = host[1:]
+		}
+		switch {
+		case host == "":
+			return nil, errors.New("negation without a host")
+		case host[0] == '|':
+			parts := strings.Split(host, "|")
+			if len(parts) != 4 || parts[1] != "1" {
+				return nil, fmt.Errorf("unsupported hashed host %s", host)
+			}
+			var err error
+			if p.salt, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+				return nil, err
+			}
+			if p.hash, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+				return nil, err
+			}
+		default:
+			var err error
+			if p.host, p.port, err = net.SplitHostPort(host); err != nil {
+				if host[0] == '[' {
+					return nil, err
+				}
+				p.host, p.port = host, "22"
+			}
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func (p *hostPattern) match(host, port string) bool {
+	if p.hash != nil {
+		mac := hmac.New(sha1.New, p.salt)
+		mac.Write([]byte(knownhosts.Normalize(net.JoinHostPort(host, port))))
+		return hmac.Equal(mac.Sum(nil), p.hash)
+	}
+	return wildcardMatch(p.host, host) && p.port == port
+}
+
+// wildcardMatch matches str against a pattern where * matches any run of
+// characters, separators included, and ? matches any one character.
+func wildcardMatch(pattern, str string) bool {
+	for pattern != "" {
+		if pattern[0] == '*' {
+			for i := 0; i <= len(str); i++ {
+				if wildcardMatch(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if str == "" || (pattern[0] != '?' && pattern[0] != str[0]) {
+			return false
+		}
+		pattern, str = pattern[1:], str[1:]
+	}
+	return str == ""
+}
+
+func (l *knownHostsLine) match(host, port string) bool {
+	matched := false
+	for i := range l.patterns {
+		if !l.patterns[i].match(host, port) {
+			continue
+		}
+		if l.patterns[i].negate {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// callback returns a HostKeyCallback checking host keys, and host certificates
+// against the @cert-authority lines.
+func (db *knownHostsDB) callback() ssh.HostKeyCallback {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: db.isHostAuthority,
+		IsRevoked:       db.isRevoked,
+		HostKeyFallback: db.check,
+	}
+	return checker.CheckHostKey
+}
+
+func (db *knownHostsDB) isHostAuthority(auth ssh.PublicKey, address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	for i := range db.lines {
+		l := &db.lines[i]
+		if l.cert && bytes.Equal(l.key.Key.Marshal(), auth.Marshal()) && l.match(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *knownHostsDB) isRevoked(cert *ssh.Certificate) bool {
+	_, revoked := db.revoked[string(cert.Marshal())]
+	if !revoked {
+		_, revoked = db.revoked[string(cert.SignatureKey.Marshal())]
+	}
+	return revoked
+}
+
+// check checks a plain host key against the lines for address, or for the
+// remote address if address is empty. Like the knownhosts package, it returns
+// a *knownhosts.KeyError for unknown and changed keys, and a
+// *knownhosts.RevokedError for revoked keys.
+func (db *knownHostsDB) check(address string, remote net.Addr, key ssh.PublicKey) error {
+	if revoked, ok := db.revoked[string(key.Marshal())]; ok {
+		return &knownhosts.RevokedError{Revoked: revoked}
+	}
+	if address == "" && remote != nil {
+		address = remote.String()
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	keyErr := &knownhosts.KeyError{}
+	for i := range db.lines {
+		l := &db.lines[i]
+		if l.cert || !l.match(host, port) {
+			continue
+		}
+		keyErr.Want = append(keyErr.Want, l.key)
+		if bytes.Equal(l.key.Key.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+	return keyErr
+}
@@ -0,0 +1,201 @@
+package revssh
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// maxLabels caps the number of labels a reverse client can register.
+const maxLabels = 64
+
+// A Selector selects reverse clients by their labels. It is a comma separated
+// list of requirements, all of which must match: "key=value", "key!=value",
+// "key" for labels that are set, and "!key" for labels that are not.
+type Selector []requirement
+
+type requirement struct {
+	key   string
+	value string
+	op    string // "=", "!=", "exists" or "!exists".
+}
+
+// ParseSelector parses a label selector such as "site=ams,role=edge".
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var r requirement
+		switch {
+		case strings.Contains(term, "!="):
+			parts := strings.SplitN(term, "!=", 2)
+			r = requirement{key: parts[0], value: parts[1], op: "!="}
+		case strings.Contains(term, "="):
+			parts := strings.SplitN(strings.Replace(term, "==", "=", 1), "=", 2)
+			r = requirement{key: parts[0], value: parts[1], op: "="}
+		case strings.HasPrefix(term, "!"):
+			r = requirement{key: term[1:], op: "!exists"}
+		default:
+			r = requirement{key: term, op: "exists"}
+		}
+		r.key = strings.TrimSpace(r.key)
+		r.value = strings.TrimSpace(r.value)
+		if err := checkLabelKey(r.key); err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %s", term, err)
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy all requirements. An empty selector
+// matches everything.
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, r := range sel {
+		v, ok := labels[r.key]
+		switch r.op {
+		case "=":
+			if !ok || v != r.value {
+				return false
+			}
+		case "!=":
+			if ok && v == r.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (sel Selector) String() string {
+	var terms []string
+	for _, r := range sel {
+		switch r.op {
+		case "=", "!=":
+			terms = append(terms, r.key+r.op+r.value)
+		case "exists":
+			terms = append(terms, r.key)
+		case "!exists":
+			terms = append(terms, "!"+r.key)
+		}
+	}
+	return strings.Join(terms, ",")
+}
+
+// ParseLabels parses "key=value" labels, as sent by reverse clients.
+func ParseLabels(list []string) (map[string]string, error) {
+	if len(list) > maxLabels {
+		return nil, fmt.Errorf("too many labels, at most %d are allowed", maxLabels)
+	}
+	labels := make(map[string]string)
+	for _, l := range list {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label %q: not key=value", l)
+		}
+		if err := checkLabelKey(parts[0]); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %s", l, err)
+		}
+		if err := checkLabelValue(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid label %q: %s", l, err)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// A LabelProvider is a ServerSettingsHandler that assigns labels to reverse
+// clients, which unlike the labels they register, they can't change.
+type LabelProvider interface {
+	// GetLabels returns the labels assigned to hostname.
+	GetLabels(hostname string) map[string]string
+}
+
+// assignedLabels returns the labels the settings assign to the names of rc,
+// those of the hostname taking precedence over those of the aliases.
+func (srv *Server) assignedLabels(rc *ReverseClientHandler) map[string]string {
+	lp, ok := srv.Settings.(LabelProvider)
+	if !ok {
+		return nil
+	}
+	labels := make(map[string]string)
+	names := rc.Names()
+	for i := len(names) - 1; i >= 0; i-- {
+		for k, v := range lp.GetLabels(names[i]) {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// parseLabelsFile parses a labels file, with a hostname followed by its
+// key=value labels on every line.
+func parseLabelsFile(path string, data []byte) map[string]map[string]string {
+	labels := make(map[string]map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		parsed, err := ParseLabels(fields[1:])
+		if err != nil {
+			log.Printf("ERROR: %s:%d: %s, skipping", path, i+1, err)
+			continue
+		}
+		hostname := strings.ToLower(fields[0])
+		if labels[hostname] == nil {
+			labels[hostname] = make(map[string]string)
+		}
+		for k, v := range parsed {
+			labels[hostname][k] = v
+		}
+	}
+	return labels
+}
+
+// FormatLabels returns labels as sorted "key=value" strings.
+func FormatLabels(labels map[string]string) []string {
+	var list []string
+	for k, v := range labels {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func checkLabelKey(key string) error {
+	if key == "" || len(key) > 63 {
+		return fmt.Errorf("key must be 1 to 63 characters")
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./", c)) {
+			return fmt.Errorf("key contains %q", c)
+		}
+	}
+	return nil
+}
+
+func checkLabelValue(value string) error {
+	if len(value) > 253 {
+		return fmt.Errorf("value longer than 253 characters")
+	}
+	for _, c := range value {
+		if c <= ' ' || c == 0x7f || c == ',' || c == '=' || c == '!' {
+			return fmt.Errorf("value contains %q", c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package revssh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Selector
+		wantErr bool
+	}{
+		{s: "", want: nil},
+		{s: "site=ams", want: Selector{{key: "site", value: "ams", op: "="}}},
+		{s: "site==ams", want: Selector{{key: "site", value: "ams", op: "="}}},
+		{s: " site = ams , role!=db ", want: Selector{{key: "site", value: "ams", op: "="}, {key: "role", value: "db", op: "!="}}},
+		{s: "gpu,!legacy", want: Selector{{key: "gpu", op: "exists"}, {key: "legacy", op: "!exists"}}},
+		{s: "site=", want: Selector{{key: "site", value: "", op: "="}}},
+		{s: "=ams", wantErr: true},
+		{s: "!", wantErr: true},
+		{s: "bad key=x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSelector(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSelector(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSelector(%q) = %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"site": "ams", "role": "edge", "gpu": ""}
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"", true},
+		{"site=ams", true},
+		{"site=fra", false},
+		{"site!=fra", true},
+		{"role!=edge", false},
+		{"gpu", true},
+		{"legacy", false},
+		{"!legacy", true},
+		{"!gpu", false},
+		{"site=ams,role=edge,!legacy", true},
+		{"site=ams,role=db", false},
+		{"zone!=a", true},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sel.Matches(labels); got != tt.want {
+			t.Errorf("%q matches = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package revssh
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Limits caps the resources a Server hands out. A zero value means no limit.
+type Limits struct {
+	MaxConnections          int           // concurrent connections.
+	MaxConnectionsPerUser   int           // concurrent authenticated connections per username.
+	MaxChannelsPerConn      int           // concurrent channels per connection.
+	MaxReverseClientsPerKey int           // reverse client registrations per public key.
+	HandshakeTimeout        time.Duration // time a client gets to finish the handshake and authenticate.
+	IdleTimeout             time.Duration // time a peer may stay silent, keepalives are sent after a third of it.
+}
+
+// connTracker counts open connections, in total and per username.
+type connTracker struct {
+	total int
+	users map[string]int
+	sync.Mutex
+}
+
+// open registers a new connection, unless max connections are already open.
+func (ct *connTracker) open(max int) bool {
+	ct.Lock()
+	defer ct.Unlock()
+	if max > 0 && ct.total >= max {
+		return false
+	}
+	ct.total++
+	return true
+}
+
+func (ct *connTracker) close() {
+	ct.Lock()
+	defer ct.Unlock()
+	ct.total--
+}
+
+// userCount returns the number of connections open for username.
+func (ct *connTracker) userCount(username string) int {
+	ct.Lock()
+	defer ct.Unlock()
+	return ct.users[username]
+}
+
+// openUser registers a new connection for username, unless max connections
+// are already open for this username.
+func (ct *connTracker) openUser(username string, max int) bool {
+	ct.Lock()
+	defer ct.Unlock()
+	if ct.users == nil {
+		ct.users = make(map[string]int)
+	}
+	if max > 0 && ct.users[username] >= max {
+		return false
+	}
+	ct.users[username]++
+	return true
+}
+
+func (ct *connTracker) closeUser(username string) {
+	ct.Lock()
+	defer ct.Unlock()
+	ct.users[username]--
+	if ct.users[username] <= 0 {
+		delete(ct.users, username)
+	}
+}
+
+// idleConn wraps a net.Conn, and once started, pushes its deadline forward on
+// every read, so the connection fails after the peer has been silent for too
+// long.
+type idleConn struct {
+	net.Conn
+	timeout  int64 // time.Duration, zero until started.
+	lastRead int64 // unix nano timestamp of the last read.
+}
+
+// start enables the idle timeout on this connection.
+func (ic *idleConn) start(timeout time.Duration) {
+	atomic.StoreInt64(&ic.timeout, int64(timeout))
+	ic.extend()
+}
+
+func (ic *idleConn) Read(b []byte) (int, error) {
+	n, err := ic.Conn.Read(b)
+	if n > 0 {
+		ic.extend()
+	}
+	return n, err
+}
+
+// idle returns how long ago the peer last sent something.
+func (ic *idleConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&ic.lastRead)))
+}
+
+func (ic *idleConn) extend() {
+	now := time.Now()
+	atomic.StoreInt64(&ic.lastRead, now.UnixNano())
+	if timeout := atomic.LoadInt64(&ic.timeout); timeout > 0 {
+		ic.Conn.SetDeadline(now.Add(time.Duration(timeout)))
+	}
+}
+
+// idleKeepAlive sends keepalives to a peer that has been silent for a third of
+// the idle timeout. Live peers answer, pushing the deadline forward, while
+// dead ones run into it.
+func idleKeepAlive(sshConn ssh.Conn, ic *idleConn, timeout time.Duration, done <-chan struct{}) {
+	interval := timeout / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if ic.idle() < interval {
+				continue
+			}
+			go sshConn.SendRequest("keepalive@openssh.com", true, nil)
+		}
+	}
+}
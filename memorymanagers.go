@@ -0,0 +1,331 @@
+package revssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// MemoryKeyManager is a KeyManager that keeps all keys in memory, for tests
+// and for embedding revssh without touching disk.
+type MemoryKeyManager struct {
+	HostKeyChecking HostKeyChecking // how unknown and changed host keys are handled.
+
+	privateKeys    []ssh.Signer
+	identityKeys   []ssh.Signer
+	retiringKeys   []ssh.Signer
+	authorizedKeys []ssh.PublicKey
+	publicKeys     map[string][]ssh.PublicKey
+	knownHosts     map[string][]ssh.PublicKey
+	sync.RWMutex
+}
+
+// NewMemoryKeyManager returns an empty MemoryKeyManager.
+func NewMemoryKeyManager() *MemoryKeyManager {
+	return &MemoryKeyManager{
+		publicKeys: make(map[string][]ssh.PublicKey),
+		knownHosts: make(map[string][]ssh.PublicKey),
+	}
+}
+
+// AddPrivateKey adds a signer to the private keys.
+func (km *MemoryKeyManager) AddPrivateKey(signer ssh.Signer) {
+	km.Lock()
+	defer km.Unlock()
+	km.privateKeys = append(km.privateKeys, signer)
+}
+
+// AddIdentityKey adds a signer to the keys a client authenticates with.
+func (km *MemoryKeyManager) AddIdentityKey(signer ssh.Signer) {
+	km.Lock()
+	defer km.Unlock()
+	km.identityKeys = append(km.identityKeys, signer)
+}
+
+// AddRetiringKey adds a signer to the host keys being rotated out.
+func (km *MemoryKeyManager) AddRetiringKey(signer ssh.Signer) {
+	km.Lock()
+	defer km.Unlock()
+	km.retiringKeys = append(km.retiringKeys, signer)
+}
+
+// AddAuthorizedKey authorizes a public key to connect.
+func (km *MemoryKeyManager) AddAuthorizedKey(key ssh.PublicKey) {
+	km.Lock()
+	defer km.Unlock()
+	km.authorizedKeys = append(km.authorizedKeys, key)
+}
+
+// AddPublicKey adds a public key for a specific username.
+func (km *MemoryKeyManager) AddPublicKey(username string, key ssh.PublicKey) {
+	km.Lock()
+	defer km.Unlock()
+	km.publicKeys[username] = append(km.publicKeys[username], key)
+}
+
+// AddKnownHost registers a public key as known for hostname.
+func (km *MemoryKeyManager) AddKnownHost(hostname string, key ssh.PublicKey) {
+	km.Lock()
+	defer km.Unlock()
+	hostname = knownhosts.Normalize(hostname)
+	km.knownHosts[hostname] = append(km.knownHosts[hostname], key)
+}
+
+// GetPublicKeys returns all publickeys for a specific username.
+func (km *MemoryKeyManager) GetPublicKeys(username string) ([]ssh.PublicKey, error) {
+	km.RLock()
+	defer km.RUnlock()
+	return append([]ssh.PublicKey(nil), km.publicKeys[username]...), nil
+}
+
+// HasUserKeys reports whether any username has public keys.
+func (km *MemoryKeyManager) HasUserKeys() bool {
+	km.RLock()
+	defer km.RUnlock()
+	return len(km.publicKeys) > 0
+}
+
+// GetAuthorizedKeys returns all public keys that are authorized to connect to this server.
+func (km *MemoryKeyManager) GetAuthorizedKeys() []ssh.PublicKey {
+	km.RLock()
+	defer km.RUnlock()
+	return append([]ssh.PublicKey(nil), km.authorizedKeys...)
+}
+
+// ListAuthorizedKeys returns the authorized keys, and the public keys of each
+// username.
+func (km *MemoryKeyManager) ListAuthorizedKeys() ([]*AuthorizedKey, error) {
+	km.RLock()
+	defer km.RUnlock()
+	var keys []*AuthorizedKey
+	for _, key := range km.authorizedKeys {
+		keys = append(keys, &AuthorizedKey{Key: key})
+	}
+	var users []string
+	for username := range km.publicKeys {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	for _, username := range users {
+		for _, key := range km.publicKeys[username] {
+			keys = append(keys, &AuthorizedKey{Key: key, Username: username})
+		}
+	}
+	return keys, nil
+}
+
+// IsKnownHost , like a ssh.HostKeyCallback, must return nil if the host key is OK,
+// or an error to reject it. Unknown and changed keys are handled as set by
+// HostKeyChecking, rejected keys result in a *HostKeyError.
+func (km *MemoryKeyManager) IsKnownHost(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	km.Lock()
+	defer km.Unlock()
+	fingerprint := ssh.FingerprintSHA256(key)
+	normalized := knownhosts.Normalize(hostname)
+	known := km.knownHosts[normalized]
+	if containsKey(known, key) {
+		return nil
+	}
+	if len(known) > 0 {
+		if km.HostKeyChecking == NoChecking {
+			return nil
+		}
+		return &HostKeyError{
+			Hostname:    hostname,
+			Fingerprint: fingerprint,
+			Reason:      fmt.Sprintf("does not match known key %s", ssh.FingerprintSHA256(known[0])),
+		}
+	}
+	switch km.HostKeyChecking {
+	case Strict:
+		return &HostKeyError{Hostname: hostname, Fingerprint: fingerprint, Reason: "is unknown", Unknown: true}
+	case Ask:
+		if !askHostKey(hostname, fingerprint) {
+			return &HostKeyError{Hostname: hostname, Fingerprint: fingerprint, Reason: "was not accepted"}
+		}
+	}
+	km.knownHosts[normalized] = append(known, key)
+	return nil
+}
+
+// KnownHostKeys returns the public keys known for hostname.
+func (km *MemoryKeyManager) KnownHostKeys(hostname string) ([]ssh.PublicKey, error) {
+	km.RLock()
+	defer km.RUnlock()
+	return append([]ssh.PublicKey(nil), km.knownHosts[knownhosts.Normalize(hostname)]...), nil
+}
+
+// UpdateKnownHost replaces the public keys known for hostname.
+func (km *MemoryKeyManager) UpdateKnownHost(hostname string, keys []ssh.PublicKey) error {
+	km.Lock()
+	defer km.Unlock()
+	km.knownHosts[knownhosts.Normalize(hostname)] = append([]ssh.PublicKey(nil), keys...)
+	return nil
+}
+
+// GetPrivateKeys returns a list of signers.
+// If no private keys are available, an ed25519 key is generated, which only
+// lives as long as this MemoryKeyManager.
+func (km *MemoryKeyManager) GetPrivateKeys() []ssh.Signer {
+	km.Lock()
+	defer km.Unlock()
+	if len(km.privateKeys) == 0 {
+		signer, err := generateMemoryKey()
+		if err != nil {
+			log.Printf("ERROR: can't generate key: %s", err)
+			return nil
+		}
+		km.privateKeys = append(km.privateKeys, signer)
+	}
+	return append([]ssh.Signer(nil), km.privateKeys...)
+}
+
+// GetIdentityKeys returns a list of signers to authenticate with.
+// If no identity keys are available, an ed25519 key is generated, which only
+// lives as long as this MemoryKeyManager.
+func (km *MemoryKeyManager) GetIdentityKeys() []ssh.Signer {
+	km.Lock()
+	defer km.Unlock()
+	if len(km.identityKeys) == 0 {
+		signer, err := generateMemoryKey()
+		if err != nil {
+			log.Printf("ERROR: can't generate key: %s", err)
+			return nil
+		}
+		km.identityKeys = append(km.identityKeys, signer)
+	}
+	return append([]ssh.Signer(nil), km.identityKeys...)
+}
+
+func generateMemoryKey() (ssh.Signer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromSigner(priv)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Generated in-memory key: %s", ssh.FingerprintSHA256(signer.PublicKey()))
+	return signer, nil
+}
+
+// GetRetiringKeys returns the host keys being rotated out.
+func (km *MemoryKeyManager) GetRetiringKeys() []ssh.Signer {
+	km.RLock()
+	defer km.RUnlock()
+	return append([]ssh.Signer(nil), km.retiringKeys...)
+}
+
+// MemoryClientSettings is a ClientSettingsHandler holding its settings in
+// memory.
+type MemoryClientSettings struct {
+	KeyManager
+	RemoteAddr string            // address:port of the server.
+	Username   string            // ssh user.
+	Host       string            // hostname to register as.
+	OtherNames []string          // aliases to register as.
+	Tags       map[string]string // labels to register with.
+
+	KeepAlive      time.Duration // interval between keepalives, 0 disables them.
+	KeepAliveCount int           // missed keepalives after which the connection is closed.
+	MinBackoff     time.Duration // minimum delay between reconnects.
+	MaxBackoff     time.Duration // maximum delay between reconnects.
+	Attempts       int           // failed connection attempts after which Connect gives up, 0 retries forever.
+}
+
+// NewMemoryClientSettings returns MemoryClientSettings with some sane
+// defaults.
+func NewMemoryClientSettings(km KeyManager, remote, username, hostname string) *MemoryClientSettings {
+	return &MemoryClientSettings{
+		KeyManager:     km,
+		RemoteAddr:     remote,
+		Username:       username,
+		Host:           hostname,
+		KeepAlive:      5 * time.Second,
+		KeepAliveCount: 5,
+		MinBackoff:     100 * time.Millisecond,
+		MaxBackoff:     1 * time.Minute,
+	}
+}
+
+func (s *MemoryClientSettings) Remote() string {
+	return s.RemoteAddr
+}
+
+func (s *MemoryClientSettings) User() string {
+	return s.Username
+}
+
+func (s *MemoryClientSettings) Hostname() string {
+	return s.Host
+}
+
+func (s *MemoryClientSettings) Aliases() []string {
+	return s.OtherNames
+}
+
+func (s *MemoryClientSettings) Labels() map[string]string {
+	return s.Tags
+}
+
+func (s *MemoryClientSettings) KeepAliveInterval() time.Duration {
+	return s.KeepAlive
+}
+
+func (s *MemoryClientSettings) KeepAliveMax() int {
+	return s.KeepAliveCount
+}
+
+func (s *MemoryClientSettings) BackoffMin() time.Duration {
+	return s.MinBackoff
+}
+
+func (s *MemoryClientSettings) BackoffMax() time.Duration {
+	return s.MaxBackoff
+}
+
+func (s *MemoryClientSettings) MaxAttempts() int {
+	return s.Attempts
+}
+
+// ListAuthorizedKeys returns the authorized keys of the KeyManager, with their
+// options if it supports it.
+func (s *MemoryClientSettings) ListAuthorizedKeys() ([]*AuthorizedKey, error) {
+	return listAuthorizedKeys(s.KeyManager)
+}
+
+// GetIdentityKeys returns the identity keys of the KeyManager, or its private
+// keys if it doesn't keep identity keys apart.
+func (s *MemoryClientSettings) GetIdentityKeys() []ssh.Signer {
+	return identityKeys(s.KeyManager)
+}
+
+// KnownHostKeys returns the public keys known for hostname, if the KeyManager
+// supports it.
+func (s *MemoryClientSettings) KnownHostKeys(hostname string) ([]ssh.PublicKey, error) {
+	updater, ok := s.KeyManager.(KnownHostsUpdater)
+	if !ok {
+		return nil, errors.New("key manager can't update known hosts")
+	}
+	return updater.KnownHostKeys(hostname)
+}
+
+// UpdateKnownHost replaces the public keys known for hostname, if the
+// KeyManager supports it.
+func (s *MemoryClientSettings) UpdateKnownHost(hostname string, keys []ssh.PublicKey) error {
+	updater, ok := s.KeyManager.(KnownHostsUpdater)
+	if !ok {
+		return errors.New("key manager can't update known hosts")
+	}
+	return updater.UpdateKnownHost(hostname, keys)
+}
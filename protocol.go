@@ -0,0 +1,137 @@
+package revssh
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ProtocolVersion is the reverse client protocol version spoken by this
+// package. Clients that don't send a version speak version 1, and get plain
+// text replies.
+const ProtocolVersion uint32 = 5
+
+// Reverse client capabilities.
+const (
+	CapabilitySSHD      = "sshd"              // serves an sshd on reverse channels.
+	CapabilityHostCerts = "host-certificates" // fetches host certificates for its sshd.
+)
+
+// clientCapabilities are the capabilities advertised by a ReverseClient.
+var clientCapabilities = []string{CapabilitySSHD, CapabilityHostCerts}
+
+// A ReverseClientReply is the server's answer to a reverse-client request,
+// for clients speaking protocol version 2 or later.
+type ReverseClientReply struct {
+	Accepted        bool
+	ProtocolVersion uint32   // negotiated protocol version.
+	Hostname        string   // canonical hostname the client is registered as.
+	Reason          string   // why the registration was rejected.
+	Temporary       bool     // the rejection may go away, the client should retry later.
+	Capabilities    []string // capabilities supported by both sides.
+	Rejected        []string // registered keys that were rejected, and why, from version 3.
+	Aliases         []string // other names the client is registered as, from version 4.
+}
+
+// reverseClientReplyV2 is the ReverseClientReply of protocol version 2.
+type reverseClientReplyV2 struct {
+	Accepted        bool
+	ProtocolVersion uint32
+	Hostname        string
+	Reason          string
+	Temporary       bool
+	Capabilities    []string
+}
+
+// A RegistrationError is returned when the server rejects a reverse client.
+type RegistrationError struct {
+	Reason    string
+	Temporary bool
+}
+
+func (e *RegistrationError) Error() string {
+	return fmt.Sprintf("reverse request rejected: %s", e.Reason)
+}
+
+// parseReverseClientData decodes a reverse-client request. Older clients send
+// fewer fields and newer ones more, so decoding errors are only fatal when
+// not even the hostname could be read.
+func parseReverseClientData(payload []byte) (*ReverseClientData, error) {
+	d := &ReverseClientData{}
+	if err := ssh.Unmarshal(payload, d); err != nil {
+		if d.Hostname == "" {
+			return nil, err
+		}
+		log.Printf("reverse client %s speaks protocol version %d: %s", d.Hostname, d.ProtocolVersion, err)
+	}
+	return d, nil
+}
+
+// serverCapabilities returns the capabilities this server supports.
+func (srv *Server) serverCapabilities() []string {
+	caps := []string{CapabilitySSHD}
+	if srv.HostCA != nil && srv.virtualDomain() != "" {
+		caps = append(caps, CapabilityHostCerts)
+	}
+	return caps
+}
+
+// negotiate returns the protocol version and the capabilities both sides
+// support.
+func (srv *Server) negotiate(d *ReverseClientData) (uint32, []string) {
+	version := d.ProtocolVersion
+	if version == 0 {
+		version = 1
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	var caps []string
+	for _, c := range srv.serverCapabilities() {
+		if hasCapability(d.Capabilities, c) {
+			caps = append(caps, c)
+		}
+	}
+	return version, caps
+}
+
+// encode returns the reply payload for a client speaking version, version 1
+// clients only get the reason, or "v1".
+func (r *ReverseClientReply) encode(version uint32) []byte {
+	if version < 2 {
+		if r.Accepted {
+			return []byte("v1")
+		}
+		return []byte(r.Reason)
+	}
+	if version == 2 {
+		return ssh.Marshal(&reverseClientReplyV2{r.Accepted, r.ProtocolVersion, r.Hostname, r.Reason, r.Temporary, r.Capabilities})
+	}
+	return ssh.Marshal(r)
+}
+
+// parseReverseClientReply decodes the server's answer, which is plain text
+// from servers speaking version 1. Replies of older versions lack the later
+// fields.
+func parseReverseClientReply(accepted bool, payload []byte) *ReverseClientReply {
+	r := &ReverseClientReply{}
+	ssh.Unmarshal(payload, r)
+	if r.Accepted == accepted && r.ProtocolVersion >= 2 && r.ProtocolVersion <= ProtocolVersion {
+		return r
+	}
+	r = &ReverseClientReply{Accepted: accepted, ProtocolVersion: 1}
+	if !accepted {
+		r.Reason = string(payload)
+	}
+	return r
+}
+
+func hasCapability(caps []string, c string) bool {
+	for i := range caps {
+		if caps[i] == c {
+			return true
+		}
+	}
+	return false
+}
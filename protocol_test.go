@@ -0,0 +1,119 @@
+package revssh
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReverseClientReplyVersions(t *testing.T) {
+	reply := &ReverseClientReply{
+		Accepted:     true,
+		Hostname:     "web1",
+		Capabilities: []string{CapabilitySSHD},
+		Rejected:     []string{"key SHA256:x: bad"},
+		Aliases:      []string{"www"},
+	}
+	tests := []struct {
+		version uint32
+		want    ReverseClientReply
+	}{
+		{version: 1, want: ReverseClientReply{Accepted: true, ProtocolVersion: 1}},
+		{version: 2, want: ReverseClientReply{Accepted: true, ProtocolVersion: 2, Hostname: "web1", Capabilities: []string{CapabilitySSHD}}},
+		{version: 3, want: ReverseClientReply{Accepted: true, ProtocolVersion: 3, Hostname: "web1", Capabilities: []string{CapabilitySSHD}, Rejected: []string{"key SHA256:x: bad"}, Aliases: []string{"www"}}},
+		{version: ProtocolVersion, want: ReverseClientReply{Accepted: true, ProtocolVersion: ProtocolVersion, Hostname: "web1", Capabilities: []string{CapabilitySSHD}, Rejected: []string{"key SHA256:x: bad"}, Aliases: []string{"www"}}},
+	}
+	for _, tt := range tests {
+		r := *reply
+		r.ProtocolVersion = tt.version
+		got := parseReverseClientReply(true, r.encode(tt.version))
+		if !sameMessage(*got, tt.want) {
+			t.Errorf("version %d: got %+v, want %+v", tt.version, *got, tt.want)
+		}
+	}
+}
+
+func TestReverseClientReplyRejected(t *testing.T) {
+	tests := []struct {
+		version uint32
+		want    ReverseClientReply
+	}{
+		{version: 1, want: ReverseClientReply{ProtocolVersion: 1, Reason: "hostname taken"}},
+		{version: 2, want: ReverseClientReply{ProtocolVersion: 2, Reason: "hostname taken", Temporary: true}},
+		{version: ProtocolVersion, want: ReverseClientReply{ProtocolVersion: ProtocolVersion, Reason: "hostname taken", Temporary: true}},
+	}
+	for _, tt := range tests {
+		r := &ReverseClientReply{ProtocolVersion: tt.version, Reason: "hostname taken", Temporary: true}
+		got := parseReverseClientReply(false, r.encode(tt.version))
+		if !sameMessage(*got, tt.want) {
+			t.Errorf("version %d: got %+v, want %+v", tt.version, *got, tt.want)
+		}
+	}
+	// a version 1 reason that happens to decode as a reply is still text.
+	if got := parseReverseClientReply(false, []byte("v1")); got.Reason != "v1" || got.ProtocolVersion != 1 {
+		t.Errorf("plain text reply = %+v", got)
+	}
+}
+
+func TestParseReverseClientData(t *testing.T) {
+	legacy := struct {
+		Version, Hostname, Username string
+		PublicKeysHex               []string
+	}{"0.1", "old", "dev", []string{"00"}}
+	v2 := struct {
+		Version, Hostname, Username string
+		PublicKeysHex, HostKeysHex  []string
+		ProtocolVersion             uint32
+		Capabilities                []string
+	}{"0.2", "mid", "dev", nil, nil, 2, []string{CapabilitySSHD}}
+	newer := ssh.Marshal(&ReverseClientData{Hostname: "new", ProtocolVersion: ProtocolVersion + 1, Labels: []string{"site=ams"}})
+	newer = append(newer, ssh.Marshal(struct{ Future string }{"x"})...)
+	tests := []struct {
+		name    string
+		payload []byte
+		want    *ReverseClientData
+		wantErr bool
+	}{
+		{name: "version 1", payload: ssh.Marshal(legacy), want: &ReverseClientData{Version: "0.1", Hostname: "old", Username: "dev", PublicKeysHex: []string{"00"}}},
+		{name: "version 2", payload: ssh.Marshal(v2), want: &ReverseClientData{Version: "0.2", Hostname: "mid", Username: "dev", ProtocolVersion: 2, Capabilities: []string{CapabilitySSHD}}},
+		{name: "newer", payload: newer, want: &ReverseClientData{Hostname: "new", ProtocolVersion: ProtocolVersion + 1, Labels: []string{"site=ams"}}},
+		{name: "garbage", payload: []byte{0, 0}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseReverseClientData(tt.payload)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !sameMessage(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	srv := NewServer()
+	tests := []struct {
+		version     uint32
+		caps        []string
+		wantVersion uint32
+		wantCaps    []string
+	}{
+		{version: 0, wantVersion: 1},
+		{version: 2, caps: []string{CapabilitySSHD, CapabilityHostCerts}, wantVersion: 2, wantCaps: []string{CapabilitySSHD}},
+		{version: ProtocolVersion + 3, caps: []string{"teleport"}, wantVersion: ProtocolVersion},
+	}
+	for _, tt := range tests {
+		version, caps := srv.negotiate(&ReverseClientData{ProtocolVersion: tt.version, Capabilities: tt.caps})
+		if version != tt.wantVersion || !equalStrings(caps, tt.wantCaps) {
+			t.Errorf("negotiate(%d, %v) = %d, %v, want %d, %v", tt.version, tt.caps, version, caps, tt.wantVersion, tt.wantCaps)
+		}
+	}
+}
+
+// sameMessage compares decoded messages, in which ssh.Unmarshal leaves empty
+// rather than nil slices.
+func sameMessage(got, want interface{}) bool {
+	return fmt.Sprintf("%+v", got) == fmt.Sprintf("%+v", want)
+}
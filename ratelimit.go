@@ -0,0 +1,282 @@
+package revssh
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A BanEvent is passed to RateLimiter.OnBan whenever a source address gets
+// banned.
+type BanEvent struct {
+	Key      string        // banned key, "addr <ip>".
+	Reason   string        // why the ban kicked in.
+	Count    int           // how many times this key has been banned in a row.
+	Duration time.Duration // length of this ban.
+	Until    time.Time     // time the ban expires.
+}
+
+// A RateLimiter limits new connections and failed authentications per source
+// address with token buckets. Once a bucket runs dry, the offending address is
+// banned. Every repeated ban doubles the ban duration, up to MaxBanTime.
+//
+// Failed authentications are also counted per username, once those run dry
+// attempts for the username are delayed until the bucket refills. Usernames
+// are never banned, so nobody can lock a user out by failing to log in as
+// them.
+type RateLimiter struct {
+	ConnRate      float64       // new connections per second allowed from one source address.
+	ConnBurst     int           // burst of new connections allowed from one source address.
+	AuthFailRate  float64       // failed authentications per second allowed per source address.
+	AuthFailBurst int           // burst of failed authentications allowed per source address.
+	UserFailRate  float64       // failed authentications per second per username before attempts are delayed, 0 disables delays.
+	UserFailBurst int           // burst of failed authentications per username before attempts are delayed.
+	BanTime       time.Duration // duration of the first ban, 0 disables bans and only refuses while a bucket is dry.
+	MaxBanTime    time.Duration // maximum duration of a ban.
+	Allowlist     []*net.IPNet  // source addresses that are never limited, delayed or banned.
+	OnBan         func(BanEvent)
+
+	buckets   map[string]*tokenBucket
+	bans      map[string]*ban
+	lastSweep time.Time
+	sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type ban struct {
+	count int
+	until time.Time
+}
+
+// NewRateLimiter returns a RateLimiter with some sane defaults: a burst of 10
+// connections then 1 per second, and a burst of 20 failed authentications then
+// 1 every 5 seconds, per source address. Bans last 1 minute, doubling up to 1
+// hour. Past 10 failed authentications for a username, attempts for it are
+// delayed to 1 every 5 seconds.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		ConnRate:      1,
+		ConnBurst:     10,
+		AuthFailRate:  0.2,
+		AuthFailBurst: 20,
+		UserFailRate:  0.2,
+		UserFailBurst: 10,
+		BanTime:       1 * time.Minute,
+		MaxBanTime:    1 * time.Hour,
+	}
+}
+
+// AllowConn returns whether a new connection from this address is accepted.
+func (rl *RateLimiter) AllowConn(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if rl.allowlisted(ip) {
+		return true
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	now := time.Now()
+	rl.sweep(now)
+	key := "addr " + ip
+	if rl.banned(key, now) {
+		return false
+	}
+	if !rl.take("conn "+ip, rl.ConnRate, rl.ConnBurst, now) {
+		rl.ban(key, "too many connections", now)
+		return false
+	}
+	return true
+}
+
+// AllowAuth returns whether an authentication attempt from this address may
+// proceed.
+func (rl *RateLimiter) AllowAuth(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if rl.allowlisted(ip) {
+		return true
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	now := time.Now()
+	return !rl.banned("addr "+ip, now)
+}
+
+// AuthDelay returns how long an authentication attempt for username, from
+// this address, has to wait for the failed authentications for username to
+// refill.
+func (rl *RateLimiter) AuthDelay(addr net.Addr, username string) time.Duration {
+	if rl.UserFailRate <= 0 || rl.allowlisted(addrIP(addr)) {
+		return 0
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	b := rl.bucket("auth user "+username, rl.UserFailRate, rl.UserFailBurst, time.Now())
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rl.UserFailRate * float64(time.Second))
+}
+
+// AuthFailed registers a failed authentication for this username, from this
+// address.
+func (rl *RateLimiter) AuthFailed(addr net.Addr, username string) {
+	ip := addrIP(addr)
+	if rl.allowlisted(ip) {
+		return
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	now := time.Now()
+	if rl.UserFailRate > 0 {
+		// never banned, AuthDelay slows attempts down once it runs dry.
+		rl.take("auth user "+username, rl.UserFailRate, rl.UserFailBurst, now)
+	}
+	key := "addr " + ip
+	if rl.banned(key, now) {
+		return
+	}
+	if !rl.take("auth "+key, rl.AuthFailRate, rl.AuthFailBurst, now) {
+		rl.ban(key, "too many failed authentications", now)
+	}
+}
+
+func (rl *RateLimiter) allowlisted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range rl.Allowlist {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes a token from the named bucket, refilling it at rate tokens per
+// second. Returns false if the bucket is empty.
+func (rl *RateLimiter) take(name string, rate float64, burst int, now time.Time) bool {
+	b := rl.bucket(name, rate, burst, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// bucket returns the named bucket, refilled at rate tokens per second.
+func (rl *RateLimiter) bucket(name string, rate float64, burst int, now time.Time) *tokenBucket {
+	if rl.buckets == nil {
+		rl.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := rl.buckets[name]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		rl.buckets[name] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	return b
+}
+
+func (rl *RateLimiter) banned(key string, now time.Time) bool {
+	b, ok := rl.bans[key]
+	return ok && now.Before(b.until)
+}
+
+func (rl *RateLimiter) ban(key, reason string, now time.Time) {
+	if rl.BanTime <= 0 {
+		log.Printf("BAN: not banning %s, bans are disabled: %s", key, reason)
+		return
+	}
+	if rl.bans == nil {
+		rl.bans = make(map[string]*ban)
+	}
+	b, ok := rl.bans[key]
+	if !ok {
+		b = &ban{}
+		rl.bans[key] = b
+	}
+	b.count++
+	d := rl.BanTime
+	for i := 1; i < b.count && d < rl.MaxBanTime; i++ {
+		d *= 2
+	}
+	if d > rl.MaxBanTime {
+		d = rl.MaxBanTime
+	}
+	b.until = now.Add(d)
+	log.Printf("BAN: %s for %s: %s", key, d, reason)
+	if rl.OnBan != nil {
+		go rl.OnBan(BanEvent{Key: key, Reason: reason, Count: b.count, Duration: d, Until: b.until})
+	}
+}
+
+// sweep forgets full buckets, and bans that expired longer than MaxBanTime ago.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < 1*time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	for name, b := range rl.buckets {
+		if now.Sub(b.last) > 1*time.Hour {
+			delete(rl.buckets, name)
+		}
+	}
+	for key, b := range rl.bans {
+		if now.Sub(b.until) > rl.MaxBanTime {
+			delete(rl.bans, key)
+		}
+	}
+}
+
+// ParseAllowlist parses a comma separated list of IP addresses and CIDR
+// networks.
+func ParseAllowlist(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allowlist address: %s", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func addrIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
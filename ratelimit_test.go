@@ -0,0 +1,209 @@
+package revssh
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseAllowlist(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{list: "", want: nil},
+		{list: "10.0.0.1", want: []string{"10.0.0.1/32"}},
+		{list: "10.0.0.0/8, 192.168.1.0/24", want: []string{"10.0.0.0/8", "192.168.1.0/24"}},
+		{list: "::1,2001:db8::/32", want: []string{"::1/128", "2001:db8::/32"}},
+		{list: "10.0.0.1,,", want: []string{"10.0.0.1/32"}},
+		{list: "10.0.0.300", wantErr: true},
+		{list: "10.0.0.0/33", wantErr: true},
+		{list: "example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		nets, err := ParseAllowlist(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAllowlist(%q) error = %v, wantErr %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, n := range nets {
+			got = append(got, n.String())
+		}
+		if !equalStrings(got, tt.want) {
+			t.Errorf("ParseAllowlist(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestParseAllowlistContains(t *testing.T) {
+	nets, err := ParseAllowlist("10.1.2.3,192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"10.1.2.4", false},
+		{"192.168.55.1", true},
+		{"::ffff:10.1.2.3", true},
+	}
+	for _, tt := range tests {
+		got := false
+		for _, n := range nets {
+			got = got || n.Contains(net.ParseIP(tt.ip))
+		}
+		if got != tt.want {
+			t.Errorf("%s allowed = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRateLimiterBucketRefill(t *testing.T) {
+	rl := NewRateLimiter()
+	now := time.Now()
+	tests := []struct {
+		after time.Duration // since the start.
+		want  bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false}, // burst of 2 used up.
+		{400 * time.Millisecond, false},
+		{500 * time.Millisecond, true}, // refilled at 2 per second.
+		{500 * time.Millisecond, false},
+		{time.Hour, true}, // refilled up to the burst only.
+		{time.Hour, true},
+		{time.Hour, false},
+	}
+	for i, tt := range tests {
+		if got := rl.take("test", 2, 2, now.Add(tt.after)); got != tt.want {
+			t.Errorf("take %d after %s = %v, want %v", i, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterBan(t *testing.T) {
+	rl := NewRateLimiter()
+	rl.ConnBurst = 3
+	rl.ConnRate = 0.001
+	addr := testAddr("192.0.2.1:1234")
+	for i := 0; i < 3; i++ {
+		if !rl.AllowConn(addr) {
+			t.Fatalf("connection %d refused within the burst", i+1)
+		}
+	}
+	if rl.AllowConn(addr) {
+		t.Fatal("connection past the burst allowed")
+	}
+	if !rl.banned("addr 192.0.2.1", time.Now()) || rl.AllowAuth(addr) {
+		t.Error("address not banned once its bucket ran dry")
+	}
+	if !rl.AllowConn(testAddr("192.0.2.2:1234")) {
+		t.Error("other address refused")
+	}
+}
+
+func TestRateLimiterBanGrowth(t *testing.T) {
+	rl := NewRateLimiter()
+	rl.BanTime = time.Minute
+	rl.MaxBanTime = 10 * time.Minute
+	now := time.Now()
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		rl.ban("addr x", "test", now)
+		if got := rl.bans["addr x"].until.Sub(now); got != want {
+			t.Errorf("ban %d lasts %s, want %s", rl.bans["addr x"].count, got, want)
+		}
+	}
+	if !rl.banned("addr x", now.Add(9*time.Minute)) || rl.banned("addr x", now.Add(10*time.Minute)) {
+		t.Error("ban doesn't expire at its end")
+	}
+
+	rl.BanTime = 0
+	rl.ban("addr y", "test", now)
+	if rl.banned("addr y", now) {
+		t.Error("banned with bans disabled")
+	}
+}
+
+func TestRateLimiterAllowlist(t *testing.T) {
+	rl := NewRateLimiter()
+	rl.ConnBurst = 1
+	rl.AuthFailBurst = 1
+	rl.UserFailBurst = 1
+	var err error
+	if rl.Allowlist, err = ParseAllowlist("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3:22", true},
+		{"192.0.2.1:22", false},
+	}
+	for _, tt := range tests {
+		addr := testAddr(tt.addr)
+		for i := 0; i < 3; i++ {
+			rl.AllowConn(addr)
+			rl.AuthFailed(addr, "alice-"+tt.addr)
+		}
+		if got := rl.AllowConn(addr); got != tt.want {
+			t.Errorf("%s: AllowConn = %v, want %v", tt.addr, got, tt.want)
+		}
+		if got := rl.AllowAuth(addr); got != tt.want {
+			t.Errorf("%s: AllowAuth = %v, want %v", tt.addr, got, tt.want)
+		}
+		if got := rl.AuthDelay(addr, "alice-"+tt.addr) == 0; got != tt.want {
+			t.Errorf("%s: not delayed = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterUserDelay(t *testing.T) {
+	rl := NewRateLimiter()
+	rl.UserFailRate = 1
+	rl.UserFailBurst = 2
+	// failures for alice from many addresses, none of which gets banned.
+	for i := 0; i < 5; i++ {
+		addr := testAddr(fmt.Sprintf("192.0.2.%d:22", i))
+		if d := rl.AuthDelay(addr, "alice"); (d > 0) != (i >= 2) {
+			t.Errorf("attempt %d delayed by %s", i+1, d)
+		}
+		rl.AuthFailed(addr, "alice")
+	}
+	addr := testAddr("198.51.100.1:22")
+	if !rl.AllowAuth(addr) {
+		t.Error("the real user is refused")
+	}
+	if d := rl.AuthDelay(addr, "alice"); d <= 0 || d > time.Second {
+		t.Errorf("alice delayed by %s, want up to 1s", d)
+	}
+	if d := rl.AuthDelay(addr, "bob"); d != 0 {
+		t.Errorf("bob delayed by %s", d)
+	}
+	if len(rl.bans) != 0 {
+		t.Errorf("bans = %v, want none", rl.bans)
+	}
+
+	rl.UserFailRate = 0
+	if d := rl.AuthDelay(addr, "alice"); d != 0 {
+		t.Errorf("delayed by %s with delays disabled", d)
+	}
+}
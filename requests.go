@@ -14,25 +14,81 @@ type requestHandler func(srv *Server, sshConn *ssh.ServerConn, req *ssh.Request)
 type ReverseClientData struct {
 	Version       string   // Implementation version.
 	Hostname      string   // Hostname to register.
-	Username      string   // Username to register the ssh keys under.
-	PublicKeysHex []string // list of ssh Publickeys, in hex. (for marshalling purposes)
+	Username      string   // Username to register the ssh keys under, the server uses the user of the connection.
+	PublicKeysHex []string // list of ssh Publickeys, in hex, for servers older than version 3.
+	HostKeysHex   []string // host keys of the embedded sshd, in hex.
+
+	ProtocolVersion uint32   // reverse client protocol version, 0 for version 1 clients.
+	Capabilities    []string // capabilities of the client.
+	Keys            []byte   // authorized keys with options and usernames, from version 3.
+	Aliases         []string // other names to register, from version 4.
+	Labels          []string // labels as key=value, from version 5.
 }
 
 func reverseClientRequestHandler(srv *Server, sshConn *ssh.ServerConn, req *ssh.Request) {
 	log.Printf("Reverse client registration received for client: %s", sshConn.User())
-	d := &ReverseClientData{}
-	if err := ssh.Unmarshal(req.Payload, d); err != nil {
+	d, err := parseReverseClientData(req.Payload)
+	if err != nil {
 		log.Printf("%+v", err)
+		req.Reply(false, []byte("invalid registration"))
+		return
+	}
+	version, caps := srv.negotiate(d)
+	reject := func(reason string, temporary bool) {
+		log.Printf("Rejecting reverse client %s: %s", d.Hostname, reason)
+		reply := &ReverseClientReply{ProtocolVersion: version, Reason: reason, Temporary: temporary}
+		req.Reply(false, reply.encode(version))
+	}
+	if version < srv.MinProtocolVersion {
+		reject(fmt.Sprintf("protocol version %d is not supported, need at least %d", version, srv.MinProtocolVersion), false)
+		return
+	}
+	if ud, ok := srv.Settings.(UserDirectory); ok && ud.GetUser(sshConn.User()) != nil {
+		reject(fmt.Sprintf("user %s is defined on the server and can't register reverse clients", sshConn.User()), false)
+		return
+	}
+	hostname, err := srv.normalizeHostname(d.Hostname)
+	if err != nil {
+		reject(err.Error(), false)
+		return
 	}
-	sessionKey := srv.GetSession(sshConn.SessionID())
-	// TODO: normalize hostname / port
-	err := srv.Settings.IsKnownHost(fmt.Sprintf("%s:22", d.Hostname), sshConn.RemoteAddr(), sessionKey)
+	d.Hostname = hostname
+	sessionKey := connKey(sshConn)
+	err = srv.Settings.IsKnownHost(fmt.Sprintf("%s:22", d.Hostname), sshConn.RemoteAddr(), sessionKey)
 	if err != nil {
 		log.Printf("%+v", err)
-		req.Reply(false, []byte("v1"))
+		reject(fmt.Sprintf("hostname %s is registered with another key", d.Hostname), false)
 		return
 	}
 
+	// aliases are bound to the key like the hostname, those configured on the
+	// server are trusted as is.
+	var aliases, rejected []string
+	for _, alias := range cleanAliases(d.Hostname, d.Aliases) {
+		alias, err := srv.normalizeHostname(alias)
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("alias %s", err))
+			continue
+		}
+		if err := srv.Settings.IsKnownHost(fmt.Sprintf("%s:22", alias), sshConn.RemoteAddr(), sessionKey); err != nil {
+			log.Printf("%+v", err)
+			rejected = append(rejected, fmt.Sprintf("alias %s: registered with another key", alias))
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+	if ap, ok := srv.Settings.(AliasProvider); ok {
+		for _, alias := range ap.GetAliases(d.Hostname) {
+			alias, err := srv.normalizeHostname(alias)
+			if err != nil {
+				log.Printf("ERROR: configured alias for %s: %s", d.Hostname, err)
+				continue
+			}
+			aliases = append(aliases, alias)
+		}
+	}
+	d.Aliases = aliases
+
 	// if knownKey == nil {
 	// 	_ = srv.Settings.AddKnownHost(d.Hostname, sessionKey)
 	// }
@@ -40,16 +96,25 @@ func reverseClientRequestHandler(srv *Server, sshConn *ssh.ServerConn, req *ssh.
 	// 	log.Printf("hostname already registered")
 	// 	req.Reply(false, []byte("v1"))
 	// }
-	err = srv.NewReverseClient(sshConn, d)
+	rc, err := srv.newReverseClient(sshConn, d, rejected, srv.Limits.MaxReverseClientsPerKey)
 	if err != nil {
-		log.Printf("%+v", err)
-		req.Reply(false, []byte("v1"))
+		reject(err.Error(), err == errTooManyForKey)
 		return
 	}
-	req.Reply(true, []byte("v1"))
+	for _, r := range rc.Rejected {
+		log.Printf("Reverse client %s: rejected %s", rc.Hostname, r)
+	}
+	reply := &ReverseClientReply{Accepted: true, ProtocolVersion: version, Hostname: srv.canonicalHostname(rc.Hostname), Capabilities: caps, Rejected: rc.Rejected, Aliases: rc.Aliases}
+	req.Reply(true, reply.encode(version))
+	if srv.ReverseKeepAliveInterval > 0 {
+		go srv.probeReverseClient(rc)
+	}
 }
 
 func keepaliveRequestHandler(srv *Server, sshConn *ssh.ServerConn, req *ssh.Request) {
 	// log.Printf("keepalive request from %s", sshConn.User())
+	if rc, err := srv.GetReverseClientBySession(sshConn.SessionID()); err == nil {
+		rc.Seen(0)
+	}
 	req.Reply(true, nil)
 }
@@ -3,6 +3,7 @@ package revssh
 import (
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"strings"
@@ -21,6 +22,55 @@ type ClientSettingsHandler interface {
 	Remote() string
 	User() string
 	Hostname() string
+	// Aliases returns other names to register as.
+	Aliases() []string
+	// Labels returns labels to register with, such as site or role.
+	Labels() map[string]string
+	// GetIdentityKeys returns the signers to authenticate to the server with,
+	// while GetPrivateKeys returns the host keys of the embedded sshd.
+	GetIdentityKeys() []ssh.Signer
+	// KeepAliveInterval returns the interval between keepalives, 0 disables them.
+	KeepAliveInterval() time.Duration
+	// KeepAliveMax returns the number of missed keepalives after which the
+	// connection is closed.
+	KeepAliveMax() int
+	// BackoffMin and BackoffMax return the bounds of the reconnect backoff.
+	BackoffMin() time.Duration
+	BackoffMax() time.Duration
+	// MaxAttempts returns the number of failed connection and registration
+	// attempts in a row after which Connect gives up, 0 retries forever.
+	MaxAttempts() int
+}
+
+// A ClientState describes where a ReverseClient is in its connection cycle.
+type ClientState int
+
+// ReverseClient connection states.
+const (
+	StateDisconnected ClientState = iota // not connected.
+	StateConnecting                      // dialing the server.
+	StateConnected                       // connected and authenticated.
+	StateRegistered                      // registered as a reverse client.
+	StateBackingOff                      // waiting to reconnect.
+	StateGaveUp                          // too many failed attempts, Connect returned.
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateRegistered:
+		return "registered"
+	case StateBackingOff:
+		return "backing off"
+	case StateGaveUp:
+		return "gave up"
+	}
+	return fmt.Sprintf("ClientState(%d)", int(s))
 }
 
 // A ReverseClient represents an instance of a reverse client.
@@ -33,9 +83,17 @@ type ReverseClient struct {
 	// Hostname to register yourself as.
 	// Hostname string
 	Settings ClientSettingsHandler
+	// OnStateChange, if set, is called on every connection state change.
+	OnStateChange func(ClientState)
+	// Signers, if set, returns extra signers to authenticate with, tried
+	// before the identity keys from Settings. See AgentSigners.
+	Signers func() ([]ssh.Signer, error)
 
 	version     string
 	authMethods []ssh.AuthMethod
+	state       ClientState
+	hostKey     ssh.PublicKey // host key of the current connection.
+	stateMu     sync.Mutex
 }
 
 // NewReverseClient returns a ReverseClient instance, with some sane defaults.
@@ -49,8 +107,9 @@ func NewReverseClient() *ReverseClient {
 
 // Connect to a server.
 // Connections will be retried with a backoff mechanism.
-// If the error is unrecoverable (no ssh keys set etc), this wil exit with
-// an error.
+// If the error is unrecoverable (a rejected host key, ErrNoIdentityKeys etc),
+// this wil exit with an error. After a registered session ends, it waits at
+// least BackoffMin before reconnecting.
 func (rc *ReverseClient) Connect() error {
 	if rc.Settings.Remote() == "" {
 		return errors.New("no remote specified")
@@ -63,33 +122,83 @@ func (rc *ReverseClient) Connect() error {
 	// 	rc.Hostname = hostname
 	// }
 	b := &backoff.Backoff{
-		Max:    1 * time.Minute,
+		Min:    rc.Settings.BackoffMin(),
+		Max:    rc.Settings.BackoffMax(),
 		Jitter: true,
 	}
+	attempts := 0
 	for {
-		conn, err := ssh.Dial("tcp", rc.Settings.Remote(), rc.config())
+		rc.setState(StateConnecting)
+		conn, err := rc.dial()
 		if err != nil {
-			if strings.HasSuffix(err.Error(), "key not found") {
+			var hkErr *HostKeyError
+			if errors.As(err, &hkErr) || errors.Is(err, ErrNoIdentityKeys) {
+				rc.setState(StateDisconnected)
 				return err
 			}
+			attempts++
+			if max := rc.Settings.MaxAttempts(); max > 0 && attempts >= max {
+				rc.setState(StateGaveUp)
+				return fmt.Errorf("giving up after %d attempts: %s", attempts, err)
+			}
 			d := b.Duration()
 			log.Printf("%s, reconnecting in %s", err, d)
+			rc.setState(StateBackingOff)
 			time.Sleep(d)
 			continue
 		}
 		log.Printf("Connected to %s", conn.RemoteAddr())
-		b.Reset()
-		go keepAlive(conn)
-		var once sync.Once
-		defer once.Do(func() { conn.Close() })
+		rc.setState(StateConnected)
+		if interval := rc.Settings.KeepAliveInterval(); interval > 0 {
+			go keepAlive(conn, interval, rc.Settings.KeepAliveMax())
+		}
 		err = rc.Reverse(conn)
-		if err != nil {
-			if strings.HasSuffix(err.Error(), "reverse request rejected") {
-				return err
-			}
-			log.Printf("%+v", err)
+		conn.Close()
+		var regErr *RegistrationError
+		if errors.As(err, &regErr) && !regErr.Temporary {
+			rc.setState(StateDisconnected)
+			return err
+		}
+		rc.setState(StateDisconnected)
+		if err == nil {
+			// only a registration resets the backoff, so a server that
+			// keeps turning us away is retried ever more slowly. Even so,
+			// wait before reconnecting, clients sharing a key and hostname
+			// take the registration over from each other.
+			b.Reset()
+			attempts = 0
+			d := b.Duration()
+			log.Printf("Disconnected, reconnecting in %s", d)
+			rc.setState(StateBackingOff)
+			time.Sleep(d)
+			continue
 		}
-		once.Do(func() { conn.Close() })
+		attempts++
+		if max := rc.Settings.MaxAttempts(); max > 0 && attempts >= max {
+			rc.setState(StateGaveUp)
+			return fmt.Errorf("giving up after %d attempts: %s", attempts, err)
+		}
+		d := b.Duration()
+		log.Printf("%+v, reconnecting in %s", err, d)
+		rc.setState(StateBackingOff)
+		time.Sleep(d)
+	}
+}
+
+// State returns the current connection state.
+func (rc *ReverseClient) State() ClientState {
+	rc.stateMu.Lock()
+	defer rc.stateMu.Unlock()
+	return rc.state
+}
+
+func (rc *ReverseClient) setState(state ClientState) {
+	rc.stateMu.Lock()
+	changed := rc.state != state
+	rc.state = state
+	rc.stateMu.Unlock()
+	if changed && rc.OnStateChange != nil {
+		rc.OnStateChange(state)
 	}
 }
 
@@ -98,29 +207,93 @@ func (rc *ReverseClient) Connect() error {
 // Listen to incoming `reverse` channel requests, and bind an sshd to this
 // channel.
 func (rc *ReverseClient) Reverse(conn *ssh.Client) error {
-	pkdata := rc.Settings.GetAuthorizedKeys()
+	keys, err := listAuthorizedKeys(rc.Settings)
+	if err != nil {
+		log.Printf("ERROR: %+v", err)
+	}
+	keys = userAuthorizedKeys(keys, rc.Settings.User())
+	// servers older than version 3 ignore options and usernames, so they only
+	// get the keys that don't need them.
 	var data []string
-	for i := range pkdata {
-		data = append(data, hex.EncodeToString(pkdata[i].Marshal()))
+	for _, ak := range keys {
+		if ak.Username == "" && len(ak.Options) == 0 {
+			data = append(data, hex.EncodeToString(ak.Key.Marshal()))
+		}
 	}
 
-	clientdata := &ReverseClientData{Version: rc.version, Hostname: rc.Settings.Hostname(), Username: rc.Settings.User(), PublicKeysHex: data}
-	b, _, err := conn.SendRequest("reverse-client", true, ssh.Marshal(clientdata))
+	var hostKeys []string
+	for _, signer := range rc.Settings.GetPrivateKeys() {
+		hostKeys = append(hostKeys, hex.EncodeToString(signer.PublicKey().Marshal()))
+	}
+
+	clientdata := &ReverseClientData{
+		Version:         rc.version,
+		Hostname:        rc.Settings.Hostname(),
+		Username:        rc.Settings.User(),
+		PublicKeysHex:   data,
+		HostKeysHex:     hostKeys,
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    clientCapabilities,
+		Keys:            marshalRegistrationKeys(keys),
+		Aliases:         rc.Settings.Aliases(),
+		Labels:          FormatLabels(rc.Settings.Labels()),
+	}
+	b, payload, err := conn.SendRequest("reverse-client", true, ssh.Marshal(clientdata))
 	if err != nil {
-		log.Printf("ERROR: %+v", err)
+		return err
+	}
+	reply := parseReverseClientReply(b, payload)
+	if !reply.Accepted {
+		return &RegistrationError{Reason: reply.Reason, Temporary: reply.Temporary}
 	}
-	if b == false {
-		log.Printf("reverse request rejected")
-		return errors.New("reverse request rejected")
+	if reply.Hostname != "" {
+		log.Printf("Registered as %s, protocol version %d", strings.Join(append([]string{reply.Hostname}, reply.Aliases...), ", "), reply.ProtocolVersion)
 	}
+	for _, r := range reply.Rejected {
+		log.Printf("Server rejected %s", r)
+	}
+	rc.setState(StateRegistered)
 	revchan := conn.HandleChannelOpen("reverse")
-	sshd := &Server{}
-	sshd.Settings = rc.Settings
+	settings := &hostCertSettings{ClientSettingsHandler: rc.Settings}
+	done := make(chan struct{})
+	defer close(done)
+	if hasCapability(reply.Capabilities, CapabilityHostCerts) {
+		go settings.refreshHostCerts(conn, settings.refresh(conn), done)
+	}
+	sshd := NewServer()
+	sshd.Settings = settings
 	sshd.AllowReverse = false
 	sshd.ServeChan(revchan)
 	return nil
 }
 
+// dial connects to the server. Host key announcements from the server are
+// handled here, other global requests are passed on to the ssh.Client.
+func (rc *ReverseClient) dial() (*ssh.Client, error) {
+	netConn, err := net.DialTimeout("tcp", rc.Settings.Remote(), dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(netConn, rc.Settings.Remote(), rc.config())
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	passed := make(chan *ssh.Request)
+	client := ssh.NewClient(c, chans, passed)
+	go func() {
+		defer close(passed)
+		for req := range reqs {
+			if req.Type == hostKeysRequest {
+				go rc.updateHostKeys(client, req.Payload)
+				continue
+			}
+			passed <- req
+		}
+	}()
+	return client, nil
+}
+
 // VersionString returns a proper ssh server string as per RFC 4253 Section 4.2
 func (rc *ReverseClient) VersionString() string {
 	if rc.version == "" {
@@ -136,30 +309,63 @@ func (rc *ReverseClient) config() *ssh.ClientConfig {
 	config := &ssh.ClientConfig{
 		ClientVersion: rc.VersionString(),
 		User:          rc.Settings.User(),
-		Auth:          []ssh.AuthMethod{ssh.PublicKeys(rc.Settings.GetPrivateKeys()...)},
+		Auth:          []ssh.AuthMethod{ssh.PublicKeysCallback(rc.signers)},
 		// HostKeyCallback: khkb,
 		HostKeyCallback: rc.hostKeyCallback,
 	}
 	return config
 }
 
+// signers returns the signers from rc.Signers, followed by the identity keys
+// from the settings.
+func (rc *ReverseClient) signers() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	if rc.Signers != nil {
+		extra, err := rc.Signers()
+		if err != nil {
+			log.Printf("ERROR: %+v", err)
+		}
+		signers = append(signers, extra...)
+	}
+	signers = append(signers, rc.Settings.GetIdentityKeys()...)
+	if len(signers) == 0 {
+		return nil, ErrNoIdentityKeys
+	}
+	return signers, nil
+}
+
 // HostKeyCallback is the function type used for verifying server
 // keys. A HostKeyCallback must return nil if the host key is OK, or
 // an error to reject it. It receives the hostname as passed to Dial
 // or NewClientConn. The remote address is the RemoteAddr of the
 // net.Conn underlying the the SSH connection.
 func (rc *ReverseClient) hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
-	return rc.Settings.IsKnownHost(hostname, remote, key)
+	if err := rc.Settings.IsKnownHost(hostname, remote, key); err != nil {
+		return err
+	}
+	rc.stateMu.Lock()
+	defer rc.stateMu.Unlock()
+	rc.hostKey = key
+	return nil
 }
 
-func keepAlive(conn *ssh.Client) {
+func (rc *ReverseClient) currentHostKey() ssh.PublicKey {
+	rc.stateMu.Lock()
+	defer rc.stateMu.Unlock()
+	return rc.hostKey
+}
+
+func keepAlive(conn *ssh.Client, interval time.Duration, max int) {
+	if max < 1 {
+		max = 1
+	}
 	count := 0
 	for {
-		if count >= 5 {
+		if count >= max {
 			conn.Close()
 			return
 		}
-		time.Sleep(5 * time.Second)
+		time.Sleep(interval)
 		b, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
 		if err != nil {
 			log.Printf("Keepalive error %s", err)
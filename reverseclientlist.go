@@ -1,12 +1,17 @@
 package revssh
 
 import (
-	"bytes"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"net"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/cnf/revssh/revutil"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -22,37 +27,189 @@ en daarin checken of die pubkey die hostname mocht registreren
 // A ReverseClientHandler holds all the metadata of a reverse client connection.
 // This is part of the ReverseClientList
 type ReverseClientHandler struct {
-	SSHConn  ssh.Conn        // ssh connection from a reverseclient.
-	Hostname string          // Hostname for this reverseclient.
-	Username string          // Username this reverseclient will accept.
-	KeyList  []ssh.PublicKey // list of ssh.PublicKeys for this reverseclient.
-	// sync.RWMutex
+	SSHConn  ssh.Conn          // ssh connection from a reverseclient.
+	Hostname string            // Hostname for this reverseclient.
+	Username string            // Username this reverseclient will accept.
+	KeyList  []ssh.PublicKey   // list of ssh.PublicKeys for this reverseclient.
+	HostKeys []ssh.PublicKey   // host keys of the embedded sshd of this reverseclient.
+	Aliases  []string          // other names this reverseclient goes by.
+	Labels   map[string]string // labels, such as site, role or os.
+	Keys     []*AuthorizedKey  // authorized keys, with their options and usernames.
+	Rejected []string          // registered keys and aliases that were rejected, and why.
+
+	sessionKey ssh.PublicKey // key the registering session authenticated with.
+	lastSeen   time.Time
+	rtt        time.Duration
+	sync.RWMutex
+}
+
+// Seen records that the reverse client answered, and the round trip time it
+// took, if known.
+func (rc *ReverseClientHandler) Seen(rtt time.Duration) {
+	rc.Lock()
+	defer rc.Unlock()
+	rc.lastSeen = time.Now()
+	if rtt > 0 {
+		rc.rtt = rtt
+	}
 }
 
+// LastSeen returns when the reverse client last answered, and the round trip
+// time of the last keepalive.
+func (rc *ReverseClientHandler) LastSeen() (time.Time, time.Duration) {
+	rc.RLock()
+	defer rc.RUnlock()
+	return rc.lastSeen, rc.rtt
+}
+
+// numShards is the number of shards the ReverseClientList indexes are split
+// over, so lookups of different names, users and sessions rarely contend.
+const numShards = 64
+
 // A ReverseClientList maintains a list of active reverse clients, and
-// provides lookup mechanisms.
+// provides lookup mechanisms. Reverse clients are indexed by name, username,
+// session and authorized key, each index sharded by its key. Lookups only
+// lock the shard they need, registrations and removals are serialized.
 type ReverseClientList struct {
-	reverseClients []*ReverseClientHandler
-	sessions       map[string]ssh.PublicKey
+	shards [numShards]rcShard
+	regMu  sync.Mutex
+}
+
+type rcShard struct {
+	byName    map[string]*ReverseClientHandler              // hostnames and aliases.
+	bySession map[string]*ReverseClientHandler              // session IDs.
+	byUser    map[string]map[*ReverseClientHandler]struct{} // registered usernames, and usernames of keys.
+	byKey     map[string]map[*ReverseClientHandler]struct{} // marshaled authorized keys.
+	sessions  map[string]ssh.PublicKey                      // session IDs to the key added with AddSession.
+	keyCounts map[string]int                                // marshaled session keys to their registrations.
 	sync.RWMutex
 }
 
+func (rcl *ReverseClientList) shard(key string) *rcShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &rcl.shards[h.Sum32()%numShards]
+}
+
+func addToSet(m *map[string]map[*ReverseClientHandler]struct{}, key string, rc *ReverseClientHandler) {
+	if *m == nil {
+		*m = make(map[string]map[*ReverseClientHandler]struct{})
+	}
+	if (*m)[key] == nil {
+		(*m)[key] = make(map[*ReverseClientHandler]struct{})
+	}
+	(*m)[key][rc] = struct{}{}
+}
+
+func removeFromSet(m map[string]map[*ReverseClientHandler]struct{}, key string, rc *ReverseClientHandler) {
+	delete(m[key], rc)
+	if len(m[key]) == 0 {
+		delete(m, key)
+	}
+}
+
+// setMembers returns the members of the set under key in the index picked
+// from the shard for key.
+func (rcl *ReverseClientList) setMembers(key string, pick func(*rcShard) map[string]map[*ReverseClientHandler]struct{}) []*ReverseClientHandler {
+	sh := rcl.shard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	var list []*ReverseClientHandler
+	for rc := range pick(sh)[key] {
+		list = append(list, rc)
+	}
+	return list
+}
+
+// userIndexKeys returns the usernames a reverse client is indexed under.
+func userIndexKeys(rc *ReverseClientHandler) []string {
+	users := []string{rc.Username}
+	for _, ak := range rc.Keys {
+		if ak.Username != "" && ak.Username != rc.Username {
+			users = append(users, ak.Username)
+		}
+	}
+	return users
+}
+
 // NewReverseClient registers a new reverse client to the list, and logs which
 // pubkey was used to do so. If a previous entry for this hostname exists with
 // the same pubkey, it is overwritten. If a previous entry for this hostname
-// exists with another pubkey, the registration is rejected.
+// exists with another pubkey, the registration is rejected, as is a second
+// registration on the same session.
 func (rcl *ReverseClientList) NewReverseClient(sshConn *ssh.ServerConn, data *ReverseClientData) error {
-	// TODO: add known_hosts working
-	// lookup van session ID naar public key
-	// lookup if public key can register hostname
-	// replace existing ssh conn if one exists
+	_, err := rcl.newReverseClient(sshConn, data, nil, 0)
+	return err
+}
+
+// errTooManyForKey rejects a registration that would exceed the reverse
+// clients allowed per key.
+var errTooManyForKey = errors.New("too many reverse clients for this key")
+
+// errSessionRegistered rejects a second registration on a session.
+var errSessionRegistered = errors.New("session already registered a reverse client")
+
+// newReverseClient registers a new reverse client, with the registration
+// entries the caller already rejected. If maxPerKey is above 0, at most that
+// many reverse clients may be registered with the key of the session.
+func (rcl *ReverseClientList) newReverseClient(sshConn *ssh.ServerConn, data *ReverseClientData, rejected []string, maxPerKey int) (*ReverseClientHandler, error) {
 	rc := &ReverseClientHandler{
-		Hostname: strings.ToLower(data.Hostname),
-		Username: data.Username,
-		SSHConn:  sshConn,
+		Hostname:   strings.ToLower(data.Hostname),
+		Username:   sshConn.User(),
+		Aliases:    cleanAliases(data.Hostname, data.Aliases),
+		SSHConn:    sshConn,
+		sessionKey: connKey(sshConn),
+		Rejected:   rejected,
+		lastSeen:   time.Now(),
+	}
+	if rc.sessionKey == nil {
+		rc.sessionKey = rcl.GetSession(sshConn.SessionID())
+	}
+	if len(rc.Aliases) > maxAliases {
+		return nil, fmt.Errorf("too many aliases, at most %d are allowed", maxAliases)
+	}
+	labels, err := ParseLabels(data.Labels)
+	if err != nil {
+		return nil, err
+	}
+	rc.Labels = labels
+	if data.ProtocolVersion >= 3 {
+		keys, bad, err := parseRegistrationKeys(data.Keys)
+		if err != nil {
+			return nil, err
+		}
+		rc.Rejected = append(rc.Rejected, bad...)
+		// keys only log in as the registering user, so a reverse client
+		// can't hand out access to the reverse clients of other users.
+		for _, ak := range keys {
+			if ak.Username != "" && ak.Username != rc.Username {
+				rc.Rejected = append(rc.Rejected, fmt.Sprintf("key %s: username %s is not %s", ssh.FingerprintSHA256(ak.Key), ak.Username, rc.Username))
+				continue
+			}
+			rc.Keys = append(rc.Keys, ak)
+		}
+	} else {
+		for i := range data.PublicKeysHex {
+			kb, err := hex.DecodeString(data.PublicKeysHex[i])
+			if err != nil {
+				rc.Rejected = append(rc.Rejected, fmt.Sprintf("key %d: %s", i+1, err))
+				continue
+			}
+			key, err := ssh.ParsePublicKey(kb)
+			if err != nil {
+				rc.Rejected = append(rc.Rejected, fmt.Sprintf("key %d: %s", i+1, err))
+				continue
+			}
+			rc.Keys = append(rc.Keys, &AuthorizedKey{Key: key})
+		}
 	}
-	for i := range data.PublicKeysHex {
-		kb, err := hex.DecodeString(data.PublicKeysHex[i])
+	for _, ak := range rc.Keys {
+		if ak.Username == "" && len(ak.Options) == 0 {
+			rc.KeyList = append(rc.KeyList, ak.Key)
+		}
+	}
+	for i := range data.HostKeysHex {
+		kb, err := hex.DecodeString(data.HostKeysHex[i])
 		if err != nil {
 			continue
 		}
@@ -60,87 +217,309 @@ func (rcl *ReverseClientList) NewReverseClient(sshConn *ssh.ServerConn, data *Re
 		if err != nil {
 			continue
 		}
-		rc.KeyList = append(rc.KeyList, key)
+		log.Printf("Reverse client %s has host key %s", rc.Hostname, ssh.FingerprintSHA256(key))
+		rc.HostKeys = append(rc.HostKeys, key)
 	}
-	rcl.Lock()
-	defer rcl.Unlock()
-	log.Printf("Adding %s as a reverse client", rc.Hostname)
-	rcl.reverseClients = append(rcl.reverseClients, rc)
-	return nil
+	rcl.regMu.Lock()
+	// a session holds a single registration, so its names can't be swapped
+	// out from under the handlers serving them.
+	if _, err := rcl.GetReverseClientBySession(sshConn.SessionID()); err == nil {
+		rcl.regMu.Unlock()
+		return nil, errSessionRegistered
+	}
+	stale, err := rcl.claimNames(rc)
+	if err != nil {
+		rcl.regMu.Unlock()
+		return nil, err
+	}
+	// stale clients share the key, and make room for this one.
+	if maxPerKey > 0 && rcl.CountReverseClients(rc.sessionKey)-len(stale) >= maxPerKey {
+		rcl.regMu.Unlock()
+		return nil, errTooManyForKey
+	}
+	for _, other := range stale {
+		rcl.remove(other)
+	}
+	log.Printf("Adding %s as a reverse client", strings.Join(rc.Names(), ", "))
+	rcl.add(rc)
+	rcl.regMu.Unlock()
+	for _, other := range stale {
+		log.Printf("Replacing stale reverse client %s", other.Hostname)
+		other.SSHConn.Close()
+	}
+	return rc, nil
 }
 
-// RemoveReverseClient removes a reverseclient from the list.
-func (rcl *ReverseClientList) RemoveReverseClient(sessionID []byte) error {
-	rcl.Lock()
-	defer rcl.Unlock()
-	var tmparr []*ReverseClientHandler
-	for i := range rcl.reverseClients {
-		if rcl.reverseClients[i] == nil {
-			log.Printf("WHY IS THIS revclientlist  NIL? %+v", sessionID)
-			continue
+// claimNames checks the names of a new reverse client against the registered
+// ones. A name held by a client registered with the same key is taken over,
+// and that client is returned as stale. Conflicting aliases are dropped and
+// reported, a conflicting hostname is an error. Must be called with regMu
+// held.
+func (rcl *ReverseClientList) claimNames(rc *ReverseClientHandler) (stale []*ReverseClientHandler, err error) {
+	sameKey := func(other *ReverseClientHandler) bool {
+		return rc.sessionKey != nil && revutil.KeysEqual(other.sessionKey, rc.sessionKey)
+	}
+	if other := rcl.lookupName(rc.Hostname); other != nil {
+		if !sameKey(other) {
+			return nil, fmt.Errorf("hostname %s is already registered", rc.Hostname)
 		}
-		if bytes.Equal(rcl.reverseClients[i].SSHConn.SessionID(), sessionID) {
-			log.Printf("Removing %s as a reverse client", rcl.reverseClients[i].Hostname)
+		stale = append(stale, other)
+	}
+	var aliases []string
+	for _, alias := range rc.Aliases {
+		other := rcl.lookupName(alias)
+		if other != nil && !sameKey(other) {
+			rc.Rejected = append(rc.Rejected, fmt.Sprintf("alias %s: already registered", alias))
 			continue
-			// rcl.reverseClients = append(rcl.reverseClients[:i], rcl.reverseClients[i+1:]...)
 		}
-		tmparr = append(tmparr, rcl.reverseClients[i])
+		if other != nil && !containsHandler(stale, other) {
+			stale = append(stale, other)
+		}
+		aliases = append(aliases, alias)
+	}
+	rc.Aliases = aliases
+	return stale, nil
+}
+
+// add indexes a reverse client. Must be called with regMu held.
+func (rcl *ReverseClientList) add(rc *ReverseClientHandler) {
+	for _, name := range rc.Names() {
+		sh := rcl.shard(name)
+		sh.Lock()
+		if sh.byName == nil {
+			sh.byName = make(map[string]*ReverseClientHandler)
+		}
+		sh.byName[name] = rc
+		sh.Unlock()
+	}
+	id := hex.EncodeToString(rc.SSHConn.SessionID())
+	sh := rcl.shard(id)
+	sh.Lock()
+	if sh.bySession == nil {
+		sh.bySession = make(map[string]*ReverseClientHandler)
+	}
+	sh.bySession[id] = rc
+	sh.Unlock()
+	for _, user := range userIndexKeys(rc) {
+		sh := rcl.shard(user)
+		sh.Lock()
+		addToSet(&sh.byUser, user, rc)
+		sh.Unlock()
+	}
+	for _, ak := range rc.Keys {
+		blob := string(ak.Key.Marshal())
+		sh := rcl.shard(blob)
+		sh.Lock()
+		addToSet(&sh.byKey, blob, rc)
+		sh.Unlock()
+	}
+	if rc.sessionKey != nil {
+		blob := string(rc.sessionKey.Marshal())
+		sh := rcl.shard(blob)
+		sh.Lock()
+		if sh.keyCounts == nil {
+			sh.keyCounts = make(map[string]int)
+		}
+		sh.keyCounts[blob]++
+		sh.Unlock()
+	}
+}
 
+// remove drops a reverse client from the indexes. Must be called with regMu
+// held.
+func (rcl *ReverseClientList) remove(rc *ReverseClientHandler) {
+	for _, name := range rc.Names() {
+		sh := rcl.shard(name)
+		sh.Lock()
+		if sh.byName[name] == rc {
+			delete(sh.byName, name)
+		}
+		sh.Unlock()
+	}
+	id := hex.EncodeToString(rc.SSHConn.SessionID())
+	sh := rcl.shard(id)
+	sh.Lock()
+	if sh.bySession[id] == rc {
+		delete(sh.bySession, id)
 	}
-	rcl.reverseClients = tmparr
+	sh.Unlock()
+	for _, user := range userIndexKeys(rc) {
+		sh := rcl.shard(user)
+		sh.Lock()
+		removeFromSet(sh.byUser, user, rc)
+		sh.Unlock()
+	}
+	for _, ak := range rc.Keys {
+		blob := string(ak.Key.Marshal())
+		sh := rcl.shard(blob)
+		sh.Lock()
+		removeFromSet(sh.byKey, blob, rc)
+		sh.Unlock()
+	}
+	if rc.sessionKey != nil {
+		blob := string(rc.sessionKey.Marshal())
+		sh := rcl.shard(blob)
+		sh.Lock()
+		if sh.keyCounts[blob]--; sh.keyCounts[blob] <= 0 {
+			delete(sh.keyCounts, blob)
+		}
+		sh.Unlock()
+	}
+}
+
+func (rcl *ReverseClientList) lookupName(name string) *ReverseClientHandler {
+	sh := rcl.shard(name)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.byName[name]
+}
+
+// RemoveReverseClient removes a reverseclient from the list.
+func (rcl *ReverseClientList) RemoveReverseClient(sessionID []byte) error {
+	rcl.regMu.Lock()
+	defer rcl.regMu.Unlock()
+	rc, err := rcl.GetReverseClientBySession(sessionID)
+	if err != nil {
+		return nil
+	}
+	log.Printf("Removing %s as a reverse client", rc.Hostname)
+	rcl.remove(rc)
 	return nil
 }
 
 // GetReverseClient returns a reverseclient from a hostname and username.
 func (rcl *ReverseClientList) GetReverseClient(hostname string, username string) (*ReverseClientHandler, error) {
-	rcl.RLock()
-	defer rcl.RUnlock()
-	for _, rc := range rcl.reverseClients {
-		if rc.Hostname == strings.ToLower(hostname) && rc.Username == username {
-			return rc, nil
+	rc := rcl.lookupName(strings.ToLower(hostname))
+	if rc == nil || rc.Username != username {
+		return nil, errors.New("no reverse connection found")
+	}
+	return rc, nil
+}
+
+// GetReverseClientBySession returns the reverseclient registered by a session.
+func (rcl *ReverseClientList) GetReverseClientBySession(sessionID []byte) (*ReverseClientHandler, error) {
+	id := hex.EncodeToString(sessionID)
+	sh := rcl.shard(id)
+	sh.RLock()
+	defer sh.RUnlock()
+	rc, ok := sh.bySession[id]
+	if !ok {
+		return nil, errors.New("no reverse connection found")
+	}
+	return rc, nil
+}
+
+// ListReverseClients returns all registered reverse clients.
+func (rcl *ReverseClientList) ListReverseClients() []*ReverseClientHandler {
+	var list []*ReverseClientHandler
+	for i := range rcl.shards {
+		sh := &rcl.shards[i]
+		sh.RLock()
+		for _, rc := range sh.bySession {
+			list = append(list, rc)
 		}
+		sh.RUnlock()
 	}
-	return nil, errors.New("no reverse connection found")
+	return list
 }
 
 // GetPublicKeys returns a list of ssh.PublicKeys registered for a specific
 // username by reverseclients.
 func (rcl *ReverseClientList) GetPublicKeys(username string) ([]ssh.PublicKey, error) {
-	// func (rcl *ReverseClientList) GetPublicKeys(remoteKey ssh.PublicKey) error {
-	rcl.RLock()
-	defer rcl.RUnlock()
 	var keys []ssh.PublicKey
-	for ci := range rcl.reverseClients {
-		if rcl.reverseClients[ci].Username == username {
-			keys = append(keys, rcl.reverseClients[ci].KeyList...)
+	for _, rc := range rcl.setMembers(username, func(sh *rcShard) map[string]map[*ReverseClientHandler]struct{} { return sh.byUser }) {
+		if rc.Username == username {
+			keys = append(keys, rc.KeyList...)
 		}
 	}
 	return keys, nil
 }
 
-// AddSession registers a session to a certain public key.
+// SelectReverseClients returns the reverse clients registered for username
+// whose labels match the selector.
+func (rcl *ReverseClientList) SelectReverseClients(username string, sel Selector) []*ReverseClientHandler {
+	var list []*ReverseClientHandler
+	for _, rc := range rcl.setMembers(username, func(sh *rcShard) map[string]map[*ReverseClientHandler]struct{} { return sh.byUser }) {
+		if rc.Username == username && sel.Matches(rc.Labels) {
+			list = append(list, rc)
+		}
+	}
+	return list
+}
+
+// AuthorizeKey checks a key against the keys registered by reverse clients
+// for username, returning the permissions of the first key that authorizes it
+// and the reverse client that registered it. Certificates are checked against
+// the certificate authorities that signed them.
+func (rcl *ReverseClientList) AuthorizeKey(username string, remote net.Addr, key ssh.PublicKey) (*ssh.Permissions, *ReverseClientHandler, bool) {
+	blobs := []string{string(key.Marshal())}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		blobs = append(blobs, string(cert.SignatureKey.Marshal()))
+	}
+	for _, blob := range blobs {
+		for _, rc := range rcl.setMembers(blob, func(sh *rcShard) map[string]map[*ReverseClientHandler]struct{} { return sh.byKey }) {
+			for _, ak := range rc.Keys {
+				if ak.Username != username && (ak.Username != "" || rc.Username != username) {
+					continue
+				}
+				if perm, err := ak.Authorize(username, remote, key); err == nil {
+					return perm, rc, true
+				}
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// CountReverseClients returns the number of reverse clients registered by
+// sessions authenticated with this public key.
+func (rcl *ReverseClientList) CountReverseClients(key ssh.PublicKey) int {
+	if key == nil {
+		return 0
+	}
+	blob := string(key.Marshal())
+	sh := rcl.shard(blob)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.keyCounts[blob]
+}
+
+// AddSession registers a session to a certain public key, for connections
+// that weren't authenticated by a Server, and so don't carry their key in
+// their permissions.
+//
+// Deprecated: the Server records the key in the connection permissions.
 func (rcl *ReverseClientList) AddSession(sessionID []byte, key ssh.PublicKey) error {
-	rcl.Lock()
-	defer rcl.Unlock()
-	if rcl.sessions == nil {
-		rcl.sessions = make(map[string]ssh.PublicKey)
+	id := hex.EncodeToString(sessionID)
+	sh := rcl.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	if sh.sessions == nil {
+		sh.sessions = make(map[string]ssh.PublicKey)
 	}
-	rcl.sessions[hex.EncodeToString(sessionID)] = key
+	sh.sessions[id] = key
 	return nil
 }
 
-// GetSession returns the ssh.PublicKey used by a session.
+// GetSession returns the ssh.PublicKey added for a session with AddSession.
+//
+// Deprecated: the Server records the key in the connection permissions.
 func (rcl *ReverseClientList) GetSession(sessionID []byte) ssh.PublicKey {
-	rcl.RLock()
-	defer rcl.RUnlock()
-	return rcl.sessions[hex.EncodeToString(sessionID)]
+	id := hex.EncodeToString(sessionID)
+	sh := rcl.shard(id)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.sessions[id]
 }
 
 // RemoveSession removes a session from the lookup table.
+//
+// Deprecated: the Server records the key in the connection permissions.
 func (rcl *ReverseClientList) RemoveSession(sessionID []byte) error {
-	rcl.Lock()
-	defer rcl.Unlock()
-	IDString := hex.EncodeToString(sessionID)
-	delete(rcl.sessions, IDString)
+	id := hex.EncodeToString(sessionID)
+	sh := rcl.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	delete(sh.sessions, id)
 	return nil
 }
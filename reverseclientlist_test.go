@@ -0,0 +1,218 @@
+package revssh
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	benchClients = 100000
+	benchUsers   = 1000
+)
+
+// benchConn is the ssh.Conn of a reverse client session.
+type benchConn struct {
+	ssh.Conn
+	user   string
+	id     []byte
+	closed bool
+}
+
+func (c *benchConn) User() string      { return c.user }
+func (c *benchConn) SessionID() []byte { return c.id }
+func (c *benchConn) Close() error      { c.closed = true; return nil }
+
+// benchServerConn returns a connection of user, authenticated with key.
+func benchServerConn(user string, id []byte, key ssh.PublicKey) *ssh.ServerConn {
+	perm := &ssh.Permissions{Extensions: map[string]string{
+		"pubkey":    hex.EncodeToString(key.Marshal()),
+		"pubkey-fp": ssh.FingerprintSHA256(key),
+	}}
+	return &ssh.ServerConn{Conn: &benchConn{user: user, id: id}, Permissions: perm}
+}
+
+// newBenchList returns a list of benchClients reverse clients, spread over
+// benchUsers users with a key each, which every client also registers.
+func newBenchList(b *testing.B) (*ReverseClientList, []ssh.PublicKey) {
+	log.SetOutput(ioutil.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	keys := make([]ssh.PublicKey, benchUsers)
+	for i := range keys {
+		signer, err := generateMemoryKey()
+		if err != nil {
+			b.Fatal(err)
+		}
+		keys[i] = signer.PublicKey()
+	}
+	rcl := &ReverseClientList{}
+	for i := 0; i < benchClients; i++ {
+		u := i % benchUsers
+		data := &ReverseClientData{
+			Hostname:      fmt.Sprintf("host%d", i),
+			Username:      fmt.Sprintf("user%d", u),
+			Aliases:       []string{fmt.Sprintf("alias%d", i)},
+			Labels:        []string{fmt.Sprintf("shard=%d", i%10)},
+			PublicKeysHex: []string{hex.EncodeToString(keys[u].Marshal())},
+		}
+		if err := rcl.NewReverseClient(benchServerConn(fmt.Sprintf("user%d", u), []byte(fmt.Sprintf("session%d", i)), keys[u]), data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	return rcl, keys
+}
+
+func BenchmarkReverseClientListGet(b *testing.B) {
+	rcl, _ := newBenchList(b)
+	for i := 0; i < b.N; i++ {
+		n := i % benchClients
+		if _, err := rcl.GetReverseClient(fmt.Sprintf("alias%d", n), fmt.Sprintf("user%d", n%benchUsers)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReverseClientListGetBySession(b *testing.B) {
+	rcl, _ := newBenchList(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := rcl.GetReverseClientBySession([]byte(fmt.Sprintf("session%d", i%benchClients))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReverseClientListCount(b *testing.B) {
+	rcl, keys := newBenchList(b)
+	for i := 0; i < b.N; i++ {
+		if n := rcl.CountReverseClients(keys[i%benchUsers]); n != benchClients/benchUsers {
+			b.Fatalf("counted %d reverse clients, want %d", n, benchClients/benchUsers)
+		}
+	}
+}
+
+func BenchmarkReverseClientListGetPublicKeys(b *testing.B) {
+	rcl, _ := newBenchList(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := rcl.GetPublicKeys(fmt.Sprintf("user%d", i%benchUsers)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReverseClientListAuthorizeKey(b *testing.B) {
+	rcl, keys := newBenchList(b)
+	remote := testAddr("10.0.0.1:22")
+	for i := 0; i < b.N; i++ {
+		u := i % benchUsers
+		if _, _, ok := rcl.AuthorizeKey(fmt.Sprintf("user%d", u), remote, keys[u]); !ok {
+			b.Fatal("registered key not authorized")
+		}
+	}
+}
+
+func BenchmarkReverseClientListSelect(b *testing.B) {
+	rcl, _ := newBenchList(b)
+	sel, err := ParseSelector("shard=3")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		rcl.SelectReverseClients(fmt.Sprintf("user%d", i%benchUsers), sel)
+	}
+}
+
+func BenchmarkReverseClientListList(b *testing.B) {
+	rcl, _ := newBenchList(b)
+	for i := 0; i < b.N; i++ {
+		if n := len(rcl.ListReverseClients()); n != benchClients {
+			b.Fatalf("listed %d reverse clients, want %d", n, benchClients)
+		}
+	}
+}
+
+func BenchmarkReverseClientListRegister(b *testing.B) {
+	rcl, keys := newBenchList(b)
+	for i := 0; i < b.N; i++ {
+		id := []byte(fmt.Sprintf("extra%d", i))
+		data := &ReverseClientData{Hostname: fmt.Sprintf("extra%d", i), Username: "user0"}
+		if err := rcl.NewReverseClient(benchServerConn("user0", id, keys[0]), data); err != nil {
+			b.Fatal(err)
+		}
+		rcl.RemoveReverseClient(id)
+	}
+}
+
+func TestReverseClientListOneRegistrationPerSession(t *testing.T) {
+	signer, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcl := &ReverseClientList{}
+	conn := benchServerConn("alice", []byte("session"), signer.PublicKey())
+	if err := rcl.NewReverseClient(conn, &ReverseClientData{Hostname: "web", Aliases: []string{"www"}}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := rcl.GetReverseClientBySession(conn.SessionID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hostname := range []string{"db", "web"} {
+		if err := rcl.NewReverseClient(conn, &ReverseClientData{Hostname: hostname}); err != errSessionRegistered {
+			t.Errorf("registering %s again on the session: error = %v, want %v", hostname, err, errSessionRegistered)
+		}
+	}
+	if conn.Conn.(*benchConn).closed {
+		t.Error("second registration closed its own session")
+	}
+	for _, name := range []string{"web", "www"} {
+		if rc, err := rcl.GetReverseClient(name, "alice"); err != nil || rc != first {
+			t.Errorf("GetReverseClient(%s) = %v, %v, want the first registration", name, rc, err)
+		}
+	}
+	if _, err := rcl.GetReverseClient("db", "alice"); err == nil {
+		t.Error("db registered by a second registration on the session")
+	}
+
+	rcl.RemoveReverseClient(conn.SessionID())
+	for _, name := range []string{"web", "www"} {
+		if _, err := rcl.GetReverseClient(name, "alice"); err == nil {
+			t.Errorf("%s still registered after the session ended", name)
+		}
+	}
+	if err := rcl.NewReverseClient(conn, &ReverseClientData{Hostname: "db"}); err != nil {
+		t.Errorf("registering after removal: %v", err)
+	}
+}
+
+func TestReverseClientListAddSession(t *testing.T) {
+	signer, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcl := &ReverseClientList{}
+	id := []byte("session")
+	rcl.AddSession(id, signer.PublicKey())
+	if key := rcl.GetSession(id); key == nil || !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+		t.Fatalf("GetSession = %v, want the added key", key)
+	}
+	// a connection without the key in its permissions registers with the
+	// key added for its session.
+	conn := &ssh.ServerConn{Conn: &benchConn{user: "alice", id: id}}
+	if err := rcl.NewReverseClient(conn, &ReverseClientData{Hostname: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := rcl.CountReverseClients(signer.PublicKey()); n != 1 {
+		t.Errorf("CountReverseClients = %d, want 1", n)
+	}
+	rcl.RemoveSession(id)
+	if key := rcl.GetSession(id); key != nil {
+		t.Errorf("GetSession after RemoveSession = %v, want nil", key)
+	}
+}
@@ -0,0 +1,129 @@
+package revutil
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// ErrNoPassphrase is returned by a PassphraseFunc that has no passphrase to
+// offer.
+var ErrNoPassphrase = errors.New("no passphrase available")
+
+// A PassphraseFunc returns the passphrase for the encrypted key at path.
+type PassphraseFunc func(path string) ([]byte, error)
+
+// EnvPassphrase reads the passphrase from an environment variable.
+func EnvPassphrase(name string) PassphraseFunc {
+	return func(path string) ([]byte, error) {
+		pass, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, ErrNoPassphrase
+		}
+		return []byte(pass), nil
+	}
+}
+
+// FilePassphrase reads the passphrase from the first line of a file.
+func FilePassphrase(file string) PassphraseFunc {
+	return func(path string) ([]byte, error) {
+		dat, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, ErrNoPassphrase
+			}
+			return nil, err
+		}
+		return []byte(strings.TrimRight(strings.SplitN(string(dat), "\n", 2)[0], "\r")), nil
+	}
+}
+
+// CredentialPassphrase reads the passphrase from a systemd credential, as
+// passed with LoadCredential= or SetCredential=.
+func CredentialPassphrase(name string) PassphraseFunc {
+	return func(path string) ([]byte, error) {
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return nil, ErrNoPassphrase
+		}
+		return FilePassphrase(filepath.Join(dir, name))(path)
+	}
+}
+
+var promptMu sync.Mutex
+
+// PromptPassphrase asks for the passphrase on the terminal, if there is one.
+func PromptPassphrase() PassphraseFunc {
+	return func(path string) ([]byte, error) {
+		promptMu.Lock()
+		defer promptMu.Unlock()
+		tty := os.Stdin
+		if runtime.GOOS != "windows" {
+			f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+			if err != nil {
+				return nil, ErrNoPassphrase
+			}
+			defer f.Close()
+			tty = f
+		}
+		if !term.IsTerminal(int(tty.Fd())) {
+			return nil, ErrNoPassphrase
+		}
+		fmt.Fprintf(os.Stderr, "Enter passphrase for key '%s': ", path)
+		pass, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return pass, err
+	}
+}
+
+// FirstPassphrase tries each PassphraseFunc in turn, until one has a
+// passphrase to offer.
+func FirstPassphrase(fns ...PassphraseFunc) PassphraseFunc {
+	return func(path string) ([]byte, error) {
+		for _, fn := range fns {
+			if fn == nil {
+				continue
+			}
+			pass, err := fn(path)
+			if err == ErrNoPassphrase {
+				continue
+			}
+			return pass, err
+		}
+		return nil, ErrNoPassphrase
+	}
+}
+
+// ParsePrivateKeyWithPassphrase returns an ssh.Signer from the key data read
+// from path, asking passphrase for the passphrase if the key is encrypted.
+func ParsePrivateKeyWithPassphrase(dat []byte, path string, passphrase PassphraseFunc) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(dat)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) || passphrase == nil {
+		return signer, err
+	}
+	pass, err := passphrase(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s is encrypted: %s", path, err)
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(dat, pass)
+}
+
+// ParsePrivateKeyFileWithPassphrase takes a path, and returns an ssh.Signer
+// from that file, asking passphrase for the passphrase if the key is
+// encrypted.
+func ParsePrivateKeyFileWithPassphrase(path string, passphrase PassphraseFunc) (ssh.Signer, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKeyWithPassphrase(dat, path, passphrase)
+}
@@ -4,7 +4,15 @@ Package revutil supplies various utilities needed by revssh.
 package revutil
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/subtle"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -53,3 +61,86 @@ func AppendLine(filepath, content string) error {
 	}
 	return nil
 }
+
+// GenerateKeyFile generates a new private key of keytype ("ed25519", "ecdsa"
+// or "rsa"), and writes it in OpenSSH format to path, readable only by the
+// owner. The public key is written to path.pub, replacing a stale one. An
+// existing private key is never overwritten.
+func GenerateKeyFile(path, keytype, comment string) (ssh.Signer, error) {
+	var priv crypto.Signer
+	var err error
+	switch keytype {
+	case "ed25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		priv, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", keytype)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromSigner(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeNewFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	pub := ssh.MarshalAuthorizedKey(signer.PublicKey())
+	if comment != "" {
+		pub = append(pub[:len(pub)-1], []byte(" "+comment+"\n")...)
+	}
+	if err = replaceFile(path+".pub", pub, 0644); err != nil {
+		// don't leave a key behind without its public key.
+		os.Remove(path)
+		return nil, err
+	}
+	return signer, nil
+}
+
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// replaceFile atomically replaces the contents of path with data.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// WriteLines replaces the contents of a file with lines, readable only by the
+// owner. The file is replaced atomically.
+func WriteLines(path string, lines []string) error {
+	tmp := path + ".tmp"
+	var data []byte
+	for _, line := range lines {
+		data = append(data, line+"\n"...)
+	}
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
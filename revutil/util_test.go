@@ -0,0 +1,64 @@
+package revutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateKeyFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		keytype  string
+		existing map[string]string // files present before generating.
+		wantErr  bool
+	}{
+		{name: "fresh", keytype: "ed25519"},
+		{name: "ecdsa", keytype: "ecdsa"},
+		{name: "stale public key", keytype: "ed25519", existing: map[string]string{"key.pub": "ssh-ed25519 AAAAstale old\n"}},
+		{name: "existing private key", keytype: "ed25519", existing: map[string]string{"key": "secret"}, wantErr: true},
+		{name: "unsupported type", keytype: "dsa", wantErr: true},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for name, data := range tt.existing {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		path := filepath.Join(dir, "key")
+		signer, err := GenerateKeyFile(path, tt.keytype, "test")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			if data, _ := ioutil.ReadFile(path); tt.existing["key"] != string(data) {
+				t.Errorf("%s: private key file = %q after a failure", tt.name, data)
+			}
+			continue
+		}
+		pub, err := ioutil.ReadFile(path + ".pub")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		key, comment, _, _, err := ssh.ParseAuthorizedKey(pub)
+		if err != nil || !KeysEqual(key, signer.PublicKey()) || comment != "test" {
+			t.Errorf("%s: public key file %q doesn't match the key", tt.name, pub)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: private key mode = %v, %v", tt.name, fi.Mode(), err)
+		}
+		if _, err := os.Stat(path + ".pub.tmp"); !os.IsNotExist(err) {
+			t.Errorf("%s: temporary file left behind", tt.name)
+		}
+		if strings.Contains(string(pub), "stale") {
+			t.Errorf("%s: stale public key kept", tt.name)
+		}
+	}
+}
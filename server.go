@@ -1,10 +1,13 @@
 package revssh
 
 import (
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cnf/revssh/revutil"
@@ -24,6 +27,22 @@ type Server struct {
 	MaxAuthTries int    // maximum auth retries a client can do. See ssh.ServerConfig MaxAuthTries.
 	AllowReverse bool   // does this server register reverseclients?
 	Settings     ServerSettingsHandler
+	RateLimit    *RateLimiter // limits connections and failed authentications, if set.
+	Limits       Limits       // caps connections, channels and reverse clients.
+
+	ReverseKeepAliveInterval time.Duration // interval between keepalives sent to reverse clients, 0 disables them.
+	ReverseKeepAliveMax      int           // missed keepalives after which a reverse client is evicted.
+
+	HostCA           ssh.Signer    // if set with a VirtualDomain, signs the host keys of reverse clients into host certificates for it.
+	HostCertValidity time.Duration // lifetime of the host certificates.
+
+	MinProtocolVersion uint32 // oldest reverse client protocol version accepted, 0 accepts all.
+
+	VirtualDomain     string   // domain reverse clients are reachable in, as in host.VirtualDomain.
+	ReservedHostnames []string // names reverse clients can't register.
+
+	ApprovalSelector Selector      // reverse clients forwarding to needs the approval of another admin, matched against the labels of a LabelProvider.
+	ApprovalTimeout  time.Duration // time an admin gets to approve, after which forwarding is denied.
 	// IsKnownHost       IsKnownHost
 	// GetPrivateKeys    GetPrivateKeys
 	// GetAuthorizedKeys GetAuthorizedKeys
@@ -31,6 +50,9 @@ type Server struct {
 	version         string
 	requestHandlers map[string]requestHandler
 	channelHandlers map[string]channelHandler
+	conns           connTracker
+	approvals       approvalList
+	grants          grantList
 }
 
 // NewServer returns a new ssh Server instance.
@@ -38,6 +60,13 @@ func NewServer() *Server {
 	return &Server{
 		Addr:         ":22",
 		MaxAuthTries: 0,
+		Limits:       Limits{HandshakeTimeout: 2 * time.Minute},
+
+		ReverseKeepAliveInterval: 15 * time.Second,
+		ReverseKeepAliveMax:      3,
+		HostCertValidity:         24 * time.Hour,
+		ReservedHostnames:        DefaultReservedHostnames,
+		ApprovalTimeout:          5 * time.Minute,
 	}
 }
 
@@ -67,6 +96,11 @@ func (srv *Server) ServeTCP() error {
 			}
 			return e
 		}
+		if srv.RateLimit != nil && !srv.RateLimit.AllowConn(conn.RemoteAddr()) {
+			log.Printf("Rate limited connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
 		go srv.handleConn(conn)
 	}
 }
@@ -105,10 +139,12 @@ func (srv *Server) ServerVersionString() string {
 func (srv *Server) config() *ssh.ServerConfig {
 	srv.requestHandlers = map[string]requestHandler{
 		"keepalive@openssh.com": keepaliveRequestHandler,
+		hostKeysProveRequest:    hostkeysProveRequestHandler,
 		// "reverse-client":        reverseClientRequestHandler,
 	}
 	if srv.AllowReverse {
 		srv.requestHandlers["reverse-client"] = reverseClientRequestHandler
+		srv.requestHandlers[hostCertsRequest] = hostCertsRequestHandler
 	}
 	srv.channelHandlers = map[string]channelHandler{
 		"session":      sessionChannelHandler,
@@ -116,11 +152,10 @@ func (srv *Server) config() *ssh.ServerConfig {
 	}
 
 	config := &ssh.ServerConfig{}
-	// TODO: cleanup
-	for _, signer := range srv.Settings.GetPrivateKeys() {
-		if signer == nil {
-			continue
-		}
+	// retiring keys are added last, so they replace active keys of the same
+	// type, until clients learned the active ones.
+	active, retiring := srv.hostKeys()
+	for _, signer := range append(active, retiring...) {
 		config.AddHostKey(signer)
 	}
 
@@ -134,13 +169,38 @@ func (srv *Server) config() *ssh.ServerConfig {
 func (srv *Server) handleConn(conn net.Conn) {
 	defer conn.Close()
 	log.Printf("Accepting connection from %s", conn.RemoteAddr())
-	sshConn, chans, reqs, err := ssh.NewServerConn(conn, srv.config())
+	if !srv.conns.open(srv.Limits.MaxConnections) {
+		log.Printf("Rejecting connection from %s: too many connections", conn.RemoteAddr())
+		// RFC 4253 Section 4.2 allows lines of data before the version string.
+		conn.Write([]byte("too many connections\r\n"))
+		return
+	}
+	defer srv.conns.close()
+	ic := &idleConn{Conn: conn}
+	if srv.Limits.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(srv.Limits.HandshakeTimeout))
+	}
+	sshConn, chans, reqs, err := ssh.NewServerConn(ic, srv.config())
 	if err != nil {
 		log.Printf("handleconn: %+v", err)
 		// TODO: trigger event callback
 		return
 	}
+	conn.SetDeadline(time.Time{})
+	if srv.Limits.IdleTimeout > 0 {
+		ic.start(srv.Limits.IdleTimeout)
+		done := make(chan struct{})
+		defer close(done)
+		go idleKeepAlive(sshConn, ic, srv.Limits.IdleTimeout, done)
+	}
+	if !srv.conns.openUser(sshConn.User(), srv.Limits.MaxConnectionsPerUser) {
+		log.Printf("Rejecting connection from %s: too many connections for %s", sshConn.RemoteAddr(), sshConn.User())
+		return
+	}
+	defer srv.conns.closeUser(sshConn.User())
 	go srv.requestsHandler(sshConn, reqs)
+	go srv.announceHostKeys(sshConn)
+	var channels int32
 	for ch := range chans {
 		log.Printf(" Channel Handler for: %+v", ch.ChannelType())
 		handler, found := srv.channelHandlers[ch.ChannelType()]
@@ -148,10 +208,17 @@ func (srv *Server) handleConn(conn net.Conn) {
 			ch.Reject(ssh.UnknownChannelType, "unsupported channel type")
 			continue
 		}
-		go handler(srv, sshConn, ch)
+		if max := srv.Limits.MaxChannelsPerConn; max > 0 && atomic.LoadInt32(&channels) >= int32(max) {
+			ch.Reject(ssh.ResourceShortage, "too many channels")
+			continue
+		}
+		atomic.AddInt32(&channels, 1)
+		go func(ch ssh.NewChannel) {
+			defer atomic.AddInt32(&channels, -1)
+			handler(srv, sshConn, ch)
+		}(ch)
 	}
 	srv.RemoveReverseClient(sshConn.SessionID())
-	srv.RemoveSession(sshConn.SessionID())
 	log.Printf("Closing connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
 }
 
@@ -168,42 +235,135 @@ func (srv *Server) requestsHandler(sshConn *ssh.ServerConn, reqs <-chan *ssh.Req
 
 }
 
+// hasUserKeys reports whether the settings have keys set up per user.
+func (srv *Server) hasUserKeys() bool {
+	ukm, ok := srv.Settings.(UserKeyManager)
+	return ok && ukm.HasUserKeys()
+}
+
 func (srv *Server) publicKeyCallback(remoteConn ssh.ConnMetadata, remoteKey ssh.PublicKey) (*ssh.Permissions, error) {
 	// TODO: audit this bit.
 	log.Printf("key for %s: %s", remoteConn.User(), ssh.FingerprintSHA256(remoteKey))
-	// lookup in keylist from reverseclients
-	rckeys, _ := srv.ReverseClientList.GetPublicKeys(remoteConn.User())
-	keysMatch := false
-	for i := range rckeys {
-		if revutil.KeysEqual(rckeys[i], remoteKey) {
-			log.Println("rev key found")
-			keysMatch = true
-			break
+	if srv.RateLimit != nil {
+		if !srv.RateLimit.AllowAuth(remoteConn.RemoteAddr()) {
+			return nil, errors.New("too many failed authentications")
+		}
+		if d := srv.RateLimit.AuthDelay(remoteConn.RemoteAddr(), remoteConn.User()); d > 0 {
+			log.Printf("AUTH: delaying %s from %s by %s after failed authentications", remoteConn.User(), remoteConn.RemoteAddr(), d)
+			time.Sleep(d)
+		}
+	}
+	// lookup in keylist from reverseclients, which may restrict forwarding
+	rcperm, keyrc, keysMatch := srv.ReverseClientList.AuthorizeKey(remoteConn.User(), remoteConn.RemoteAddr(), remoteKey)
+	if keysMatch {
+		log.Println("rev key found")
+	}
+	unrestricted := false
+
+	// lookup in local authorized_keys file, valid for every username until
+	// keys are set up per user.
+	if !srv.hasUserKeys() {
+		localkeys := srv.Settings.GetAuthorizedKeys()
+		for i := range localkeys {
+			if revutil.KeysEqual(localkeys[i], remoteKey) {
+				log.Println("local key found")
+				keysMatch = true
+				unrestricted = true
+				break
+			}
 		}
 	}
 
-	// lookup in local authorized_keys file
-	localkeys := srv.Settings.GetAuthorizedKeys()
-	for i := range localkeys {
-		if revutil.KeysEqual(localkeys[i], remoteKey) {
-			log.Println("local key found")
+	// lookup in the keys for this specific user
+	userkeys, err := srv.Settings.GetPublicKeys(remoteConn.User())
+	if err != nil {
+		log.Printf("%+v", err)
+	}
+	for i := range userkeys {
+		if revutil.KeysEqual(userkeys[i], remoteKey) {
+			log.Println("user key found")
 			keysMatch = true
+			unrestricted = true
 			break
 		}
 	}
 
+	// lookup in the keys of users defined in the settings, who only log in
+	// with those keys, as they carry their role and groups.
+	var dirUser *User
+	if ud, ok := srv.Settings.(UserDirectory); ok {
+		dirUser = ud.GetUser(remoteConn.User())
+	}
+	if dirUser != nil {
+		keysMatch = false
+		for i := range dirUser.Keys {
+			if revutil.KeysEqual(dirUser.Keys[i], remoteKey) {
+				log.Printf("settings key found for %s (%s)", dirUser.Name, dirUser.Role)
+				keysMatch = true
+				unrestricted = true
+				break
+			}
+		}
+	}
+
 	if !keysMatch {
 		return nil, errors.New("no matching key found")
 	}
+	if max := srv.Limits.MaxConnectionsPerUser; max > 0 && srv.conns.userCount(remoteConn.User()) >= max {
+		return nil, &ssh.BannerError{
+			Err:     errors.New("too many connections for user"),
+			Message: fmt.Sprintf("too many connections for %s\n", remoteConn.User()),
+		}
+	}
 	perm := &ssh.Permissions{
 		Extensions: map[string]string{
 			"username": remoteConn.User(),
 		},
 	}
-	srv.AddSession(remoteConn.SessionID(), remoteKey)
+	if !unrestricted && rcperm != nil {
+		// keys registered by a reverse client only reach that reverse client.
+		restrictPermitOpen(rcperm, srv.qualifiedNames(keyrc))
+		for k, v := range rcperm.Extensions {
+			perm.Extensions[k] = v
+		}
+	}
+	// the key is only known for sure from the permissions of the accepted
+	// key, the callback also sees keys the client never proves it holds.
+	perm.Extensions["pubkey"] = hex.EncodeToString(remoteKey.Marshal())
+	perm.Extensions["pubkey-fp"] = ssh.FingerprintSHA256(remoteKey)
+	if dirUser != nil {
+		perm.Extensions["role"] = string(dirUser.Role)
+		perm.Extensions["groups"] = strings.Join(dirUser.Groups, ",")
+	}
 	return perm, nil
 }
 
+// connKey returns the key sshConn authenticated with, as recorded in its
+// permissions by publicKeyCallback, or nil.
+func connKey(sshConn *ssh.ServerConn) ssh.PublicKey {
+	if sshConn.Permissions == nil {
+		return nil
+	}
+	blob, err := hex.DecodeString(sshConn.Permissions.Extensions["pubkey"])
+	if err != nil || len(blob) == 0 {
+		return nil
+	}
+	key, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// connFingerprint returns the SHA256 fingerprint of the key sshConn
+// authenticated with, or "".
+func connFingerprint(sshConn *ssh.ServerConn) string {
+	if sshConn.Permissions == nil {
+		return ""
+	}
+	return sshConn.Permissions.Extensions["pubkey-fp"]
+}
+
 func (srv *Server) authLogCallback(conn ssh.ConnMetadata, method string, err error) {
 	if err == nil {
 		switch method {
@@ -219,6 +379,11 @@ func (srv *Server) authLogCallback(conn ssh.ConnMetadata, method string, err err
 		log.Printf("AUTH: request from %s (%s) at %s", conn.User(), conn.ClientVersion(), conn.RemoteAddr())
 	case "no matching key found":
 		log.Printf("AUTH: request DENIED from %s (%s) at %s", conn.User(), conn.ClientVersion(), conn.RemoteAddr())
+		if srv.RateLimit != nil {
+			srv.RateLimit.AuthFailed(conn.RemoteAddr(), conn.User())
+		}
+	case "too many failed authentications":
+		log.Printf("AUTH: request BANNED from %s (%s) at %s", conn.User(), conn.ClientVersion(), conn.RemoteAddr())
 	default:
 		log.Printf("AUTH REJECTED: for %s from %s -> %+v -> %+v", conn.User(), conn.RemoteAddr(), method, err)
 	}
@@ -2,6 +2,8 @@ package revssh
 
 import (
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -10,11 +12,25 @@ import (
 // SSHChannelConn wraps an ssh.Channel to make it compatible with a net.Conn interface.
 type SSHChannelConn struct {
 	ssh.Channel
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	readMu   sync.Mutex
+	results  chan readResult // result of a read still running in the background.
+	leftover []byte          // data read in the background, not yet returned.
+	readErr  error           // error read in the background, returned after leftover.
+	writeMu  sync.Mutex
+}
+
+type readResult struct {
+	buf []byte
+	err error
 }
 
 // NewSSHChannelConn returns a new SSHChannelConn instanced from an ssh.Channel.
 func NewSSHChannelConn(schan ssh.Channel) *SSHChannelConn {
-	return &SSHChannelConn{schan}
+	return &SSHChannelConn{Channel: schan}
 }
 
 // LocalAddr always returns 'reverse-channel', as this is an ssh.Channel wrapper.
@@ -29,17 +45,143 @@ func (cc *SSHChannelConn) RemoteAddr() net.Addr {
 	// return &net.TCPAddr{IP: net.ParseIP("::1"), Port: 22}
 }
 
-// SetDeadline does nothing, as this is an ssh.Channel wrapper.
+// Read reads from the channel. Once the read deadline passes, it returns
+// os.ErrDeadlineExceeded, while the channel read carries on in the background
+// and is returned by the next Read.
+func (cc *SSHChannelConn) Read(b []byte) (int, error) {
+	cc.readMu.Lock()
+	defer cc.readMu.Unlock()
+	if len(cc.leftover) > 0 {
+		n := copy(b, cc.leftover)
+		cc.leftover = cc.leftover[n:]
+		return n, nil
+	}
+	if cc.readErr != nil {
+		err := cc.readErr
+		cc.readErr = nil
+		return 0, err
+	}
+	done := cc.readDeadline.wait()
+	if cc.results == nil {
+		if done == nil {
+			return cc.Channel.Read(b)
+		}
+		if isClosed(done) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		cc.results = make(chan readResult, 1)
+		go func(results chan readResult, buf []byte) {
+			n, err := cc.Channel.Read(buf)
+			results <- readResult{buf: buf[:n], err: err}
+		}(cc.results, make([]byte, len(b)))
+	}
+	select {
+	case r := <-cc.results:
+		cc.results = nil
+		n := copy(b, r.buf)
+		if n < len(r.buf) {
+			cc.leftover = r.buf[n:]
+			cc.readErr = r.err
+			return n, nil
+		}
+		return n, r.err
+	case <-done:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Write writes to the channel. Once the write deadline passes, it returns
+// os.ErrDeadlineExceeded, and the data may or may not have been written.
+func (cc *SSHChannelConn) Write(b []byte) (int, error) {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+	done := cc.writeDeadline.wait()
+	if done == nil {
+		return cc.Channel.Write(b)
+	}
+	if isClosed(done) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	results := make(chan readResult, 1)
+	buf := append([]byte(nil), b...)
+	go func() {
+		n, err := cc.Channel.Write(buf)
+		results <- readResult{buf: buf[:n], err: err}
+	}()
+	select {
+	case r := <-results:
+		return len(r.buf), r.err
+	case <-done:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// SetDeadline sets both the read and write deadlines.
 func (cc *SSHChannelConn) SetDeadline(t time.Time) error {
+	cc.readDeadline.set(t)
+	cc.writeDeadline.set(t)
 	return nil
 }
 
-// SetReadDeadline wrapper, as this is an ssh.Channel wrapper.
+// SetReadDeadline sets the deadline for current and future Read calls.
 func (cc *SSHChannelConn) SetReadDeadline(t time.Time) error {
+	cc.readDeadline.set(t)
 	return nil
 }
 
-// SetWriteDeadline wrappes, as this is an ssh.Channel wrapper.
+// SetWriteDeadline sets the deadline for current and future Write calls.
 func (cc *SSHChannelConn) SetWriteDeadline(t time.Time) error {
+	cc.writeDeadline.set(t)
 	return nil
 }
+
+// deadline is a resettable timer, closing a channel once it expires.
+type deadline struct {
+	timer  *time.Timer
+	cancel chan struct{} // nil when no deadline is set.
+	sync.Mutex
+}
+
+// set the deadline, a zero time clears it.
+func (d *deadline) set(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer fired, and closed the current cancel channel.
+		d.cancel = nil
+	}
+	d.timer = nil
+	if t.IsZero() {
+		d.cancel = nil
+		return
+	}
+	if d.cancel == nil || isClosed(d.cancel) {
+		d.cancel = make(chan struct{})
+	}
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.cancel)
+		return
+	}
+	cancel := d.cancel
+	d.timer = time.AfterFunc(dur, func() {
+		close(cancel)
+	})
+}
+
+// wait returns a channel that is closed once the deadline expires, or nil if
+// no deadline is set.
+func (d *deadline) wait() chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
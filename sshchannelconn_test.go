@@ -0,0 +1,117 @@
+package revssh
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pipeChannel is an ssh.Channel over one end of a net.Pipe.
+type pipeChannel struct {
+	net.Conn
+}
+
+func (c pipeChannel) CloseWrite() error { return c.Conn.Close() }
+func (c pipeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+func (c pipeChannel) Stderr() io.ReadWriter { return nil }
+
+func newTestChannelConn(t *testing.T) (*SSHChannelConn, net.Conn) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return NewSSHChannelConn(pipeChannel{a}), b
+}
+
+func TestSSHChannelConnReadDeadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration // from now, 0 for none.
+		write    string        // written by the peer before reading.
+		wantErr  error
+	}{
+		{name: "no deadline", write: "hello"},
+		{name: "future deadline", deadline: time.Minute, write: "hello"},
+		{name: "past deadline", deadline: -time.Second, wantErr: os.ErrDeadlineExceeded},
+		{name: "expiring deadline", deadline: 20 * time.Millisecond, wantErr: os.ErrDeadlineExceeded},
+	}
+	for _, tt := range tests {
+		cc, peer := newTestChannelConn(t)
+		if tt.deadline != 0 {
+			cc.SetReadDeadline(time.Now().Add(tt.deadline))
+		}
+		if tt.write != "" {
+			go peer.Write([]byte(tt.write))
+		}
+		buf := make([]byte, 16)
+		n, err := cc.Read(buf)
+		if err != tt.wantErr {
+			t.Errorf("%s: Read error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if string(buf[:n]) != tt.write {
+			t.Errorf("%s: Read = %q, want %q", tt.name, buf[:n], tt.write)
+		}
+	}
+}
+
+func TestSSHChannelConnReadAfterDeadline(t *testing.T) {
+	cc, peer := newTestChannelConn(t)
+	cc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 4)
+	if _, err := cc.Read(buf); err != os.ErrDeadlineExceeded {
+		t.Fatalf("Read error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	// the read carrying on in the background gets the data, which comes
+	// back, split over reads, once the deadline is cleared.
+	cc.SetReadDeadline(time.Time{})
+	go peer.Write([]byte("abcdef"))
+	var got []byte
+	for len(got) < 6 {
+		n, err := cc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "abcdef" {
+		t.Errorf("Read = %q, want %q", got, "abcdef")
+	}
+}
+
+func TestSSHChannelConnWriteDeadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		read     bool // the peer reads the data.
+		wantErr  error
+	}{
+		{name: "no deadline", read: true},
+		{name: "future deadline", deadline: time.Minute, read: true},
+		{name: "past deadline", deadline: -time.Second, wantErr: os.ErrDeadlineExceeded},
+		{name: "expiring deadline", deadline: 20 * time.Millisecond, wantErr: os.ErrDeadlineExceeded},
+	}
+	for _, tt := range tests {
+		cc, peer := newTestChannelConn(t)
+		if tt.deadline != 0 {
+			cc.SetDeadline(time.Now().Add(tt.deadline))
+		}
+		if tt.read {
+			go io.Copy(ioutil.Discard, peer)
+		}
+		n, err := cc.Write([]byte("hello"))
+		if err != tt.wantErr {
+			t.Errorf("%s: Write error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && n != 5 {
+			t.Errorf("%s: Write = %d, want 5", tt.name, n)
+		}
+	}
+}
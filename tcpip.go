@@ -1,14 +1,20 @@
 package revssh
 
 import (
-	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// dialTimeout is how long connecting to a forwarding destination, or to the
+// server, may take.
+var dialTimeout = 10 * time.Second
+
 // direct-tcpip data struct as specified in RFC4254, Section 7.2
 type forwardData struct {
 	DestinationHost string
@@ -27,10 +33,52 @@ func directTcpipChannelHandler(srv *Server, sshConn *ssh.ServerConn, newChan ssh
 		return
 	}
 	// TODO: callback to allow / deny specific forwarding
-	rc, err := srv.ReverseClientList.GetReverseClient(d.DestinationHost, sshConn.User())
-	if err != nil || rc == nil {
-		dest := fmt.Sprintf("%s:%d", d.DestinationHost, d.DestinationPort)
-		var dialer net.Dialer
+	if !srv.user(sshConn).HasRole(RoleOperator) {
+		newChan.Reject(ssh.Prohibited, "forwarding not permitted")
+		log.Printf("%s: forwarding denied to viewer", sshConn.User())
+		return
+	}
+	if err := permitOpen(sshConn.Permissions, d.DestinationHost, d.DestinationPort); err != nil {
+		newChan.Reject(ssh.Prohibited, err.Error())
+		log.Printf("%s: %s", sshConn.User(), err)
+		return
+	}
+	var rc *ReverseClientHandler
+	if hostname, err := srv.normalizeHostname(d.DestinationHost); err == nil {
+		rc = srv.ReverseClientList.lookupName(hostname)
+	}
+	var grant *Grant
+	if rc != nil && !srv.canAccess(sshConn, rc) {
+		var err error
+		if grant, err = srv.useGrant(sshConn, rc); grant == nil {
+			// only names no reverse client holds are dialed, so a denied
+			// user can't reach whatever else answers to the name.
+			if err != nil {
+				log.Printf("%s: %s", sshConn.User(), err)
+			}
+			newChan.Reject(ssh.Prohibited, "no access to "+rc.Hostname)
+			log.Printf("%s: no access to reverse client %s", sshConn.User(), rc.Hostname)
+			return
+		}
+		defer srv.releaseGrant(grant)
+		log.Printf("%s: access to %s granted by %s", sshConn.User(), rc.Hostname, grant.ID)
+	}
+	if rc != nil && srv.needsApproval(rc) {
+		a := srv.requestApproval(sshConn, rc)
+		if !a.Approved {
+			reason := "access denied by " + a.DecidedBy
+			if a.DecidedBy == "" {
+				reason = "approval timed out"
+			}
+			newChan.Reject(ssh.Prohibited, reason)
+			return
+		}
+		log.Printf("%s: forwarding to %s approved by %s (approval %s)", sshConn.User(), rc.Hostname, a.DecidedBy, a.ID)
+	}
+	if rc == nil {
+		dest := net.JoinHostPort(d.DestinationHost, strconv.Itoa(int(d.DestinationPort)))
+		dialer := net.Dialer{Timeout: dialTimeout}
+		var err error
 		conn, err = dialer.Dial("tcp", dest)
 		if err != nil {
 			newChan.Reject(ssh.ConnectionFailed, err.Error())
@@ -56,19 +104,29 @@ func directTcpipChannelHandler(srv *Server, sshConn *ssh.ServerConn, newChan ssh
 		return
 	}
 	go ssh.DiscardRequests(reqs)
+	if grant != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go grant.expire(done, ch, conn)
+	}
 
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
+		defer wg.Done()
 		defer ch.Close()
 		defer conn.Close()
 		io.Copy(ch, conn)
 	}()
 	go func() {
+		defer wg.Done()
 		defer ch.Close()
 		defer conn.Close()
 		io.Copy(conn, ch)
 
 	}()
 	log.Println("Got a reverse SSH channel")
+	wg.Wait()
 
 	// dest := fmt.Sprintf("%s:%d", d.DestinationHost, d.DestinationPort)
 	// log.Printf("direct-tcp-ip %+v", d)
@@ -0,0 +1,130 @@
+package revssh
+
+import (
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A Role sets what a user can do on the server.
+type Role string
+
+// Roles, from least to most privileged.
+const (
+	RoleViewer   Role = "viewer"   // lists reverse clients, can't forward.
+	RoleOperator Role = "operator" // forwards to the reverse clients it can access.
+	RoleAdmin    Role = "admin"    // reaches every reverse client and runs every admin command.
+)
+
+var roleRanks = map[Role]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// A User is a user defined in the server settings.
+type User struct {
+	Name   string
+	Role   Role // users without a role act as operators.
+	Groups []string
+	Keys   []ssh.PublicKey
+}
+
+// A UserDirectory is a ServerSettingsHandler that defines users, their keys,
+// groups and roles. The users it defines only log in with the keys it lists,
+// and can't register reverse clients.
+type UserDirectory interface {
+	// GetUser returns the user called name, or nil if there is none.
+	GetUser(name string) *User
+}
+
+// Users is a UserDirectory of users by name.
+type Users map[string]*User
+
+// GetUser returns the user called name, or nil if there is none.
+func (users Users) GetUser(name string) *User {
+	return users[name]
+}
+
+// HasRole reports whether the user has at least the privileges of role.
+func (u *User) HasRole(role Role) bool {
+	rank, ok := roleRanks[u.Role]
+	if !ok {
+		rank = roleRanks[RoleOperator]
+	}
+	return rank >= roleRanks[role]
+}
+
+// InGroup reports whether the user is a member of group.
+func (u *User) InGroup(group string) bool {
+	for _, g := range u.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseUsers parses a users file. Every line either defines a user with its
+// role and comma separated groups:
+//
+//	user alice admin ops,net
+//
+// or adds an authorized key for a user:
+//
+//	key alice ssh-ed25519 AAAA... alice@laptop
+func ParseUsers(path string, data []byte) Users {
+	users := make(Users)
+	get := func(name string) *User {
+		if users[name] == nil {
+			users[name] = &User{Name: name}
+		}
+		return users[name]
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			log.Printf("ERROR: %s:%d: expected %s with at least two arguments, skipping", path, i+1, fields[0])
+			continue
+		}
+		switch fields[0] {
+		case "user":
+			role := Role(fields[2])
+			if _, ok := roleRanks[role]; !ok {
+				log.Printf("ERROR: %s:%d: unknown role %q, skipping", path, i+1, role)
+				continue
+			}
+			u := get(fields[1])
+			u.Role = role
+			if len(fields) > 3 {
+				u.Groups = append(u.Groups, strings.Split(fields[3], ",")...)
+			}
+		case "key":
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[2:], " ")))
+			if err != nil {
+				log.Printf("ERROR: %s:%d: %s, skipping", path, i+1, err)
+				continue
+			}
+			u := get(fields[1])
+			u.Keys = append(u.Keys, key)
+		default:
+			log.Printf("ERROR: %s:%d: unknown directive %q, skipping", path, i+1, fields[0])
+		}
+	}
+	return users
+}
+
+// user returns the user of sshConn, with the role and groups it logged in
+// with. Users the settings don't define get no role or groups.
+func (srv *Server) user(sshConn *ssh.ServerConn) *User {
+	u := &User{Name: sshConn.User()}
+	if sshConn.Permissions == nil {
+		return u
+	}
+	u.Role = Role(sshConn.Permissions.Extensions["role"])
+	if groups := sshConn.Permissions.Extensions["groups"]; groups != "" {
+		u.Groups = strings.Split(groups, ",")
+	}
+	return u
+}
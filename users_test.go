@@ -0,0 +1,75 @@
+package revssh
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseUsers(t *testing.T) {
+	signer, err := generateMemoryKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	data := []byte(`# comment
+user alice admin ops,net
+user bob viewer
+key alice ` + key + ` alice@laptop
+key carol ` + key + `
+user dave root
+key eve ssh-ed25519 AAAAbogus
+frobnicate alice x
+user
+`)
+	users := ParseUsers("users", data)
+	tests := []struct {
+		name   string
+		exists bool
+		role   Role
+		groups []string
+		keys   int
+	}{
+		{name: "alice", exists: true, role: RoleAdmin, groups: []string{"ops", "net"}, keys: 1},
+		{name: "bob", exists: true, role: RoleViewer},
+		{name: "carol", exists: true, keys: 1},
+		{name: "dave"},
+		{name: "eve"},
+	}
+	for _, tt := range tests {
+		u := users.GetUser(tt.name)
+		if (u != nil) != tt.exists {
+			t.Errorf("%s: exists = %v, want %v", tt.name, u != nil, tt.exists)
+			continue
+		}
+		if u == nil {
+			continue
+		}
+		if u.Role != tt.role || !equalStrings(u.Groups, tt.groups) || len(u.Keys) != tt.keys {
+			t.Errorf("%s = %+v, want role %q groups %v and %d keys", tt.name, u, tt.role, tt.groups, tt.keys)
+		}
+	}
+	if len(users) != 3 {
+		t.Errorf("got %d users, want 3", len(users))
+	}
+}
+
+func TestUserHasRole(t *testing.T) {
+	tests := []struct {
+		role, want Role
+		has        bool
+	}{
+		{RoleAdmin, RoleAdmin, true},
+		{RoleAdmin, RoleViewer, true},
+		{RoleViewer, RoleOperator, false},
+		{"", RoleOperator, true},
+		{"", RoleAdmin, false},
+	}
+	for _, tt := range tests {
+		u := &User{Name: "u", Role: tt.role}
+		if got := u.HasRole(tt.want); got != tt.has {
+			t.Errorf("%q HasRole(%q) = %v, want %v", tt.role, tt.want, got, tt.has)
+		}
+	}
+}